@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	. "github.com/hammamikhairi/neural-network"
+)
+
+func FashionConvMain() {
+
+	const (
+		DATASETS_PATH string = "/home/khairi/DataSets/"
+		DATA_PATH     string = DATASETS_PATH + "Fashion/"
+
+		NUM_LABELS = 10
+	)
+
+	conf := NNConf{
+		InputShape: Shape{Channels: 1, Height: 28, Width: 28},
+		Layers: []LayerConf{
+			{Type: Conv2D_L, Filters: 8, KernelSize: 3, Padding: 1, Activation: ReLU},
+			{Type: MaxPool2D_L, PoolSize: 2},
+			{Type: Conv2D_L, Filters: 16, KernelSize: 3, Padding: 1, Activation: ReLU},
+			{Type: MaxPool2D_L, PoolSize: 2},
+			{Type: Flatten_L},
+			{Type: Dense_L, Size: 128, Activation: ReLU},
+			{Type: Dropout_L, Rate: 0.3},
+			{Type: Dense_L, Size: NUM_LABELS, Activation: Softmax},
+		},
+		Loss: CrossEntropy_T,
+	}
+
+	tConf := TrainerConf{
+		Epochs:    10,
+		Rate:      0.001,
+		Optimizer: Adam_O,
+		BatchSize: 32,
+		OnEpochComplete: func(epochIndex int, evaluation *EvaluationData, EpochLoss float64) {
+			fmt.Printf("Epoch %d -- %s -- Loss : %.4f\n", epochIndex, evaluation.GetAccuracyString(), EpochLoss)
+		},
+	}
+
+	t := NewTrainer(tConf)
+	t.NNInit(conf)
+	t.LoadMNISTData(DATA_PATH)
+	t.Train()
+
+	// eval NN
+	eval := t.Eval(true)
+	println(eval.GetAccuracyString())
+
+	// save NN to use later
+	t.SaveNN("nn-conv.json")
+}
@@ -54,6 +54,8 @@ func IncrementalTraining() {
 	// eval NN
 	eval := t.IncrementalEval(true, NUM_LABELS)
 	println(eval.GetAccuracyString())
+	// doodles are judged on the top 3 guesses
+	fmt.Printf("Top-3 accuracy : %.4f%%\n", eval.TopKAccuracy(3))
 
 	// save history for visualization
 	t.History.Save("hist-incremental.json")
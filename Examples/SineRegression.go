@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	. "github.com/hammamikhairi/neural-network"
+)
+
+// SineRegression fits sin(x) on [-3, 3], reporting regression errors
+// instead of accuracy.
+func SineRegression() {
+
+	conf := NNConf{
+		LayerSizes:    []int{1, 32, 32, 1},
+		Activation:    TanH,
+		OutActivation: Identity,
+		Loss:          MeanSquareError_T,
+	}
+
+	tConf := TrainerConf{
+		Epochs:        30,
+		TrainingSplit: 0.8,
+		Rate:          0.01,
+		Optimizer:     Adam_O,
+		BatchSize:     32,
+		Task:          RegressionTask,
+		Callbacks: []Callback{
+			&regressionLogger{},
+		},
+	}
+
+	t := NewTrainer(tConf)
+	t.NNInit(conf)
+
+	dps := []DataPoint{}
+	for i := 0; i < 2000; i++ {
+		x := rand.Float64()*6 - 3
+		dps = append(dps, NewRegressionDataPoint([]float64{x}, []float64{math.Sin(x)}))
+	}
+
+	tr, val := SplitData(dps, t.Config.TrainingSplit)
+	t.LoadCustomData(tr, val)
+
+	t.Train()
+
+	// eval NN
+	println(t.EvalRegression(true).GetErrorString())
+}
+
+type regressionLogger struct {
+	BaseCallback
+}
+
+func (l *regressionLogger) OnEpochEnd(ctx *CallbackContext) {
+	fmt.Printf("Epoch %d -- %s -- Cost : %.4f\n", ctx.Epoch, ctx.Regression.GetErrorString(), ctx.EpochLoss)
+}
@@ -47,7 +47,14 @@ func WinesMain() {
 
 	// Load Custom Data
 	winesData := LoadCustomData(DATA_PATH, numInputs, NUM_LABELS)
-	tr, val := SplitData(winesData, t.Config.TrainingSplit)
+
+	// the dataset is small, estimate how well the setup does before the
+	// final training
+	cv := CrossValidate(winesData, 5, conf, tConf)
+	println(cv.GetSummaryString())
+
+	// keep the class proportions in both sets
+	tr, val, _ := StratifiedSplit(winesData, t.Config.TrainingSplit, 1-t.Config.TrainingSplit)
 	t.LoadCustomData(tr, val)
 
 	t.Train()
@@ -10,16 +10,49 @@ const (
 	TanH
 	SiLU
 	Softmax
+	Identity
+	LeakyReLU
+	ELU
+	GELU
+	Softplus
+	HardSigmoid
+	// PReLU is a leaky ReLU whose slopes are learned, one per output node
+	// of dense layers and one per filter of convolutions.
+	PReLU
 )
 
+const Linear = Identity
+
+// IActivation works on the whole vector of weighted inputs of a layer.
 type IActivation interface {
-	Activate(inputs []float64, index int) float64
-	Derivative(inputs []float64, index int) float64
+	// Activate writes the activations of inputs to outputs.
+	Activate(inputs, outputs []float64)
+	// Backward is the vector-Jacobian product: given the inputs, their
+	// outputs and the loss gradients wrt the outputs, it writes the loss
+	// gradients wrt the inputs. inputGradients may be outputGradients.
+	Backward(inputs, outputs, outputGradients, inputGradients []float64)
 }
 
 type Activation struct{}
 
+// IParametricActivation is an activation with learned parameters, trained
+// along with the layer using it.
+type IParametricActivation interface {
+	IActivation
+	Parameters() []*Parameter
+	// AccumulateGradients adds the gradients of one sample, given its
+	// weighted inputs and the loss gradients wrt the activations.
+	AccumulateGradients(inputs, outputGradients []float64)
+}
+
 func GetActivationFromType(activationType ActivationType) IActivation {
+	return newActivation(activationType, 0)
+}
+
+// newActivation builds the activation with its alpha: the negative slope of
+// LeakyReLU, the saturation of ELU and the initial slope of PReLU. A zero
+// alpha picks the default.
+func newActivation(activationType ActivationType, alpha float64) IActivation {
 	switch activationType {
 	case Sigmoid:
 		return SigmoidActivation{}
@@ -31,75 +64,331 @@ func GetActivationFromType(activationType ActivationType) IActivation {
 		return SiLUActivation{}
 	case Softmax:
 		return SoftmaxActivation{}
+	case Identity:
+		return IdentityActivation{}
+	case LeakyReLU:
+		return LeakyReLUActivation{Alpha: defaultAlpha(alpha, 0.01)}
+	case ELU:
+		return ELUActivation{Alpha: defaultAlpha(alpha, 1)}
+	case GELU:
+		return GELUActivation{}
+	case Softplus:
+		return SoftplusActivation{}
+	case HardSigmoid:
+		return HardSigmoidActivation{}
+	case PReLU:
+		return NewPReLUActivation([]float64{defaultAlpha(alpha, 0.25)}, 0)
 	default:
 		panic("Unhandled activation type")
 	}
 }
 
+// activateEach applies fn to every input.
+func activateEach(inputs, outputs []float64, fn func(x float64) float64) {
+	for i, x := range inputs {
+		outputs[i] = fn(x)
+	}
+}
+
+// backwardEach scales every output gradient by the derivative of an
+// element-wise activation, which gets both the input and its output.
+func backwardEach(inputs, outputs, outputGradients, inputGradients []float64, derivative func(x, y float64) float64) {
+	for i, x := range inputs {
+		inputGradients[i] = outputGradients[i] * derivative(x, outputs[i])
+	}
+}
+
+func sigmoid(x float64) float64 {
+	return 1.0 / (1 + math.Exp(-x))
+}
+
 type SigmoidActivation struct{}
 
-func (a SigmoidActivation) Activate(inputs []float64, index int) float64 {
-	return 1.0 / (1 + math.Exp(-inputs[index]))
+func (a SigmoidActivation) Activate(inputs, outputs []float64) {
+	activateEach(inputs, outputs, sigmoid)
 }
 
-func (a SigmoidActivation) Derivative(inputs []float64, index int) float64 {
-	o := a.Activate(inputs, index)
-	return o * (1 - o)
+func (a SigmoidActivation) Backward(inputs, outputs, outputGradients, inputGradients []float64) {
+	backwardEach(inputs, outputs, outputGradients, inputGradients, func(x, y float64) float64 {
+		return y * (1 - y)
+	})
 }
 
 type TanHActivation struct{}
 
-func (a TanHActivation) Activate(inputs []float64, index int) float64 {
-	e2 := math.Exp(2 * inputs[index])
-	return (e2 - 1) / (e2 + 1)
+func (a TanHActivation) Activate(inputs, outputs []float64) {
+	activateEach(inputs, outputs, math.Tanh)
 }
 
-func (a TanHActivation) Derivative(inputs []float64, index int) float64 {
-	e2 := math.Exp(2 * inputs[index])
-	t := (e2 - 1) / (e2 + 1)
-	return 1 - t*t
+func (a TanHActivation) Backward(inputs, outputs, outputGradients, inputGradients []float64) {
+	backwardEach(inputs, outputs, outputGradients, inputGradients, func(x, y float64) float64 {
+		return 1 - y*y
+	})
 }
 
 type ReLUActivation struct{}
 
-func (a ReLUActivation) Activate(inputs []float64, index int) float64 {
-	return math.Max(0, inputs[index])
+func (a ReLUActivation) Activate(inputs, outputs []float64) {
+	activateEach(inputs, outputs, func(x float64) float64 { return math.Max(0, x) })
 }
 
-func (a ReLUActivation) Derivative(inputs []float64, index int) float64 {
-	if inputs[index] > 0 {
-		return 1
-	}
-	return 0
+func (a ReLUActivation) Backward(inputs, outputs, outputGradients, inputGradients []float64) {
+	backwardEach(inputs, outputs, outputGradients, inputGradients, func(x, y float64) float64 {
+		if x > 0 {
+			return 1
+		}
+		return 0
+	})
 }
 
 type SiLUActivation struct{}
 
-func (a SiLUActivation) Activate(inputs []float64, index int) float64 {
-	return inputs[index] / (1 + math.Exp(-inputs[index]))
+func (a SiLUActivation) Activate(inputs, outputs []float64) {
+	activateEach(inputs, outputs, func(x float64) float64 { return x * sigmoid(x) })
 }
 
-func (a SiLUActivation) Derivative(inputs []float64, index int) float64 {
-	sig := 1 / (1 + math.Exp(-inputs[index]))
-	return inputs[index]*sig*(1-sig) + sig
+func (a SiLUActivation) Backward(inputs, outputs, outputGradients, inputGradients []float64) {
+	backwardEach(inputs, outputs, outputGradients, inputGradients, func(x, y float64) float64 {
+		sig := sigmoid(x)
+		return x*sig*(1-sig) + sig
+	})
 }
 
 type SoftmaxActivation struct{}
 
-func (a SoftmaxActivation) Activate(inputs []float64, index int) float64 {
-	expSum := float64(0)
-	for _, input := range inputs {
-		expSum += math.Exp(input)
+// Activate subtracts the largest input before exponentiating, which leaves
+// the result unchanged but keeps the exponentials from overflowing.
+func (a SoftmaxActivation) Activate(inputs, outputs []float64) {
+	maxInput := math.Inf(-1)
+	for _, x := range inputs {
+		maxInput = math.Max(maxInput, x)
+	}
+
+	expSum := 0.0
+	for i, x := range inputs {
+		outputs[i] = math.Exp(x - maxInput)
+		expSum += outputs[i]
+	}
+	for i := range outputs {
+		outputs[i] /= expSum
+	}
+}
+
+// Backward applies the full Jacobian, dy_i/dx_j = y_i (δij - y_j), which
+// reduces to y_i (g_i - Σ_j g_j y_j).
+func (a SoftmaxActivation) Backward(inputs, outputs, outputGradients, inputGradients []float64) {
+	weightedSum := 0.0
+	for j, y := range outputs {
+		weightedSum += outputGradients[j] * y
+	}
+	for i, y := range outputs {
+		inputGradients[i] = y * (outputGradients[i] - weightedSum)
+	}
+}
+
+// IdentityActivation passes the weighted inputs through, for regression
+// outputs.
+type IdentityActivation struct{}
+
+func (a IdentityActivation) Activate(inputs, outputs []float64) {
+	copy(outputs, inputs)
+}
+
+func (a IdentityActivation) Backward(inputs, outputs, outputGradients, inputGradients []float64) {
+	copy(inputGradients, outputGradients)
+}
+
+func defaultAlpha(alpha, def float64) float64 {
+	if alpha == 0 {
+		return def
+	}
+	return alpha
+}
+
+type LeakyReLUActivation struct {
+	Alpha float64
+}
+
+func (a LeakyReLUActivation) Activate(inputs, outputs []float64) {
+	activateEach(inputs, outputs, func(x float64) float64 {
+		if x > 0 {
+			return x
+		}
+		return a.Alpha * x
+	})
+}
+
+func (a LeakyReLUActivation) Backward(inputs, outputs, outputGradients, inputGradients []float64) {
+	backwardEach(inputs, outputs, outputGradients, inputGradients, func(x, y float64) float64 {
+		if x > 0 {
+			return 1
+		}
+		return a.Alpha
+	})
+}
+
+type ELUActivation struct {
+	Alpha float64
+}
+
+func (a ELUActivation) Activate(inputs, outputs []float64) {
+	activateEach(inputs, outputs, func(x float64) float64 {
+		if x > 0 {
+			return x
+		}
+		return a.Alpha * math.Expm1(x)
+	})
+}
+
+func (a ELUActivation) Backward(inputs, outputs, outputGradients, inputGradients []float64) {
+	backwardEach(inputs, outputs, outputGradients, inputGradients, func(x, y float64) float64 {
+		if x > 0 {
+			return 1
+		}
+		return y + a.Alpha
+	})
+}
+
+// GELUActivation is the exact x * Φ(x), Φ being the standard normal CDF.
+type GELUActivation struct{}
+
+func (a GELUActivation) Activate(inputs, outputs []float64) {
+	activateEach(inputs, outputs, func(x float64) float64 {
+		return 0.5 * x * (1 + math.Erf(x/math.Sqrt2))
+	})
+}
+
+func (a GELUActivation) Backward(inputs, outputs, outputGradients, inputGradients []float64) {
+	backwardEach(inputs, outputs, outputGradients, inputGradients, func(x, y float64) float64 {
+		cdf := 0.5 * (1 + math.Erf(x/math.Sqrt2))
+		pdf := math.Exp(-x*x/2) / math.Sqrt(2*math.Pi)
+		return cdf + x*pdf
+	})
+}
+
+type SoftplusActivation struct{}
+
+// Activate computes log(1 + e^x) without overflowing for large x.
+func (a SoftplusActivation) Activate(inputs, outputs []float64) {
+	activateEach(inputs, outputs, func(x float64) float64 {
+		return math.Max(x, 0) + math.Log1p(math.Exp(-math.Abs(x)))
+	})
+}
+
+func (a SoftplusActivation) Backward(inputs, outputs, outputGradients, inputGradients []float64) {
+	backwardEach(inputs, outputs, outputGradients, inputGradients, func(x, y float64) float64 {
+		return sigmoid(x)
+	})
+}
+
+// HardSigmoidActivation is the piecewise linear x/6 + 1/2, clipped to [0, 1].
+type HardSigmoidActivation struct{}
+
+func (a HardSigmoidActivation) Activate(inputs, outputs []float64) {
+	activateEach(inputs, outputs, func(x float64) float64 {
+		return math.Min(1, math.Max(0, x/6+0.5))
+	})
+}
+
+func (a HardSigmoidActivation) Backward(inputs, outputs, outputGradients, inputGradients []float64) {
+	backwardEach(inputs, outputs, outputGradients, inputGradients, func(x, y float64) float64 {
+		if x > -3 && x < 3 {
+			return 1.0 / 6
+		}
+		return 0
+	})
+}
+
+// PReLUActivation uses Slopes[i / ChannelSize] as the negative slope of
+// node i. A ChannelSize of 0 shares the first slope between all nodes.
+type PReLUActivation struct {
+	Slopes      []float64
+	ChannelSize int
+
+	gradients []float64
+	state     *OptimizerState
+}
+
+func NewPReLUActivation(slopes []float64, channelSize int) *PReLUActivation {
+	return &PReLUActivation{
+		Slopes:      slopes,
+		ChannelSize: channelSize,
+		gradients:   make([]float64, len(slopes)),
+		state:       NewOptimizerState(len(slopes)),
+	}
+}
+
+func (a *PReLUActivation) slopeIndex(index int) int {
+	if a.ChannelSize == 0 {
+		return 0
+	}
+	return index / a.ChannelSize
+}
+
+func (a *PReLUActivation) Activate(inputs, outputs []float64) {
+	for i, x := range inputs {
+		outputs[i] = x
+		if x <= 0 {
+			outputs[i] = a.Slopes[a.slopeIndex(i)] * x
+		}
 	}
-	return math.Exp(inputs[index]) / expSum
 }
 
-func (a SoftmaxActivation) Derivative(inputs []float64, index int) float64 {
-	expSum := float64(0)
-	for _, input := range inputs {
-		expSum += math.Exp(input)
+func (a *PReLUActivation) Backward(inputs, outputs, outputGradients, inputGradients []float64) {
+	for i, x := range inputs {
+		inputGradients[i] = outputGradients[i]
+		if x <= 0 {
+			inputGradients[i] *= a.Slopes[a.slopeIndex(i)]
+		}
 	}
-	ex := math.Exp(inputs[index])
+}
+
+func (a *PReLUActivation) Parameters() []*Parameter {
+	return []*Parameter{{Values: a.Slopes, Gradients: a.gradients, State: a.state}}
+}
+
+func (a *PReLUActivation) AccumulateGradients(inputs, outputGradients []float64) {
+	for i, x := range inputs {
+		if x < 0 {
+			a.gradients[a.slopeIndex(i)] += outputGradients[i] * x
+		}
+	}
+}
 
-	return (ex*expSum - ex*ex) / (expSum * expSum)
+// layerActivation builds the activation of a layer. PReLU gets numChannels
+// learned slopes, kept in slopes so they are saved with the layer, other
+// activations clear them.
+func layerActivation(act ActivationType, alpha float64, slopes *[]float64, numChannels, channelSize int) IActivation {
+	if act != PReLU {
+		*slopes = nil
+		return newActivation(act, alpha)
+	}
+
+	if len(*slopes) != numChannels {
+		*slopes = make([]float64, numChannels)
+		for i := range *slopes {
+			(*slopes)[i] = defaultAlpha(alpha, 0.25)
+		}
+	}
+	return NewPReLUActivation(*slopes, channelSize)
+}
+
+// activationParameters lists the learned parameters of act, if any.
+func activationParameters(act IActivation) []*Parameter {
+	if parametric, ok := act.(IParametricActivation); ok {
+		return parametric.Parameters()
+	}
+	return nil
+}
+
+// accumulateActivationGradients runs before the output gradients are turned
+// into node values, while they are still wrt the activations.
+func accumulateActivationGradients(act IActivation, weightedInputs, outputGradients *Matrix) {
+	parametric, ok := act.(IParametricActivation)
+	if !ok {
+		return
+	}
+	for s := 0; s < outputGradients.Rows; s++ {
+		parametric.AccumulateGradients(weightedInputs.Row(s), outputGradients.Row(s))
+	}
 }
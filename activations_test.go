@@ -0,0 +1,160 @@
+package neuralnetwork
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+var allActivations = []ActivationType{
+	Sigmoid, ReLU, TanH, SiLU, Softmax, Identity,
+	LeakyReLU, ELU, GELU, Softplus, HardSigmoid, PReLU,
+}
+
+// awayFromKinks draws inputs that aren't close to the points where ReLU-like
+// and hard activations aren't differentiable.
+func awayFromKinks(rng *rand.Rand, n int) []float64 {
+	inputs := make([]float64, n)
+	for i := range inputs {
+		x := rng.NormFloat64() * 2
+		for math.Abs(x) < 1e-3 || math.Abs(math.Abs(x)-3) < 1e-3 {
+			x = rng.NormFloat64() * 2
+		}
+		inputs[i] = x
+	}
+	return inputs
+}
+
+// TestActivationBackward compares every Backward against the numeric
+// gradient of Σ_j g_j f(x)_j, which covers the off-diagonal Jacobian terms
+// of softmax.
+func TestActivationBackward(t *testing.T) {
+	const n, h = 7, 1e-6
+	rng := rand.New(rand.NewSource(1))
+
+	for _, actType := range allActivations {
+		act := GetActivationFromType(actType)
+		for trial := 0; trial < 5; trial++ {
+			inputs := awayFromKinks(rng, n)
+			outputGradients := make([]float64, n)
+			for i := range outputGradients {
+				outputGradients[i] = rng.NormFloat64()
+			}
+
+			outputs := make([]float64, n)
+			act.Activate(inputs, outputs)
+			inputGradients := make([]float64, n)
+			act.Backward(inputs, outputs, outputGradients, inputGradients)
+
+			weightedOutputs := func() float64 {
+				out := make([]float64, n)
+				act.Activate(inputs, out)
+				sum := 0.0
+				for j := range out {
+					sum += outputGradients[j] * out[j]
+				}
+				return sum
+			}
+
+			for i := range inputs {
+				x := inputs[i]
+				inputs[i] = x + h
+				plus := weightedOutputs()
+				inputs[i] = x - h
+				minus := weightedOutputs()
+				inputs[i] = x
+
+				numeric := (plus - minus) / (2 * h)
+				if diff := math.Abs(numeric - inputGradients[i]); diff > 1e-6*math.Max(1, math.Abs(numeric)) {
+					t.Errorf("activation %d, input %d: Backward gives %v, numeric gradient is %v", actType, i, inputGradients[i], numeric)
+				}
+			}
+		}
+	}
+}
+
+// TestActivationBackwardInPlace checks Backward can write its result over
+// the output gradients, as the layers do.
+func TestActivationBackwardInPlace(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for _, actType := range allActivations {
+		act := GetActivationFromType(actType)
+		inputs := awayFromKinks(rng, 5)
+		outputs := make([]float64, 5)
+		act.Activate(inputs, outputs)
+
+		gradients := []float64{0.3, -1, 0.5, 2, -0.7}
+		want := make([]float64, 5)
+		act.Backward(inputs, outputs, gradients, want)
+		act.Backward(inputs, outputs, gradients, gradients)
+
+		for i := range want {
+			if gradients[i] != want[i] {
+				t.Errorf("activation %d: in place Backward gives %v, want %v", actType, gradients, want)
+				break
+			}
+		}
+	}
+}
+
+func TestSoftmaxStable(t *testing.T) {
+	inputs := []float64{1000, 1001, 999, -1e308}
+	outputs := make([]float64, len(inputs))
+	SoftmaxActivation{}.Activate(inputs, outputs)
+
+	sum := 0.0
+	for _, y := range outputs {
+		if math.IsNaN(y) || math.IsInf(y, 0) {
+			t.Fatalf("softmax overflowed: %v", outputs)
+		}
+		sum += y
+	}
+	if math.Abs(sum-1) > 1e-12 {
+		t.Errorf("softmax outputs sum to %v, want 1", sum)
+	}
+
+	// shifting every input doesn't change softmax
+	shifted := make([]float64, 3)
+	SoftmaxActivation{}.Activate([]float64{0, 1, -1}, shifted)
+	for i := range shifted {
+		if math.Abs(shifted[i]-outputs[i]) > 1e-12 {
+			t.Errorf("softmax output %d is %v, want %v", i, outputs[i], shifted[i])
+		}
+	}
+}
+
+// TestPReLUSlopeGradients checks the slope gradients of a PReLU with one
+// slope per channel.
+func TestPReLUSlopeGradients(t *testing.T) {
+	const h = 1e-6
+	rng := rand.New(rand.NewSource(3))
+	act := NewPReLUActivation([]float64{0.1, 0.4}, 3)
+
+	inputs := awayFromKinks(rng, 6)
+	outputGradients := awayFromKinks(rng, 6)
+	act.AccumulateGradients(inputs, outputGradients)
+
+	for k := range act.Slopes {
+		weightedOutputs := func() float64 {
+			out := make([]float64, len(inputs))
+			act.Activate(inputs, out)
+			sum := 0.0
+			for j := range out {
+				sum += outputGradients[j] * out[j]
+			}
+			return sum
+		}
+
+		slope := act.Slopes[k]
+		act.Slopes[k] = slope + h
+		plus := weightedOutputs()
+		act.Slopes[k] = slope - h
+		minus := weightedOutputs()
+		act.Slopes[k] = slope
+
+		numeric := (plus - minus) / (2 * h)
+		if math.Abs(numeric-act.gradients[k]) > 1e-6 {
+			t.Errorf("slope %d: gradient %v, numeric gradient is %v", k, act.gradients[k], numeric)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package neuralnetwork
+
+import "math"
+
+// BatchNormLayer normalizes its inputs over the mini-batch, then scales and
+// shifts them by the learned Gamma and Beta. Inference uses the running
+// statistics gathered during training.
+type BatchNormLayer struct {
+	Gamma       []float64 `json:"gamma"`
+	Beta        []float64 `json:"beta"`
+	RunningMean []float64 `json:"running_mean"`
+	RunningVar  []float64 `json:"running_var"`
+	Momentum    float64   `json:"momentum"`
+	Epsilon     float64   `json:"epsilon"`
+
+	gammaGrad, betaGrad   []float64
+	gammaState, betaState *OptimizerState
+	invStd                []float64
+}
+
+func NewBatchNormLayer(size int) *BatchNormLayer {
+	bn := &BatchNormLayer{
+		Gamma:       make([]float64, size),
+		Beta:        make([]float64, size),
+		RunningMean: make([]float64, size),
+		RunningVar:  make([]float64, size),
+		Momentum:    0.9,
+		Epsilon:     1e-5,
+	}
+	for i := range bn.Gamma {
+		bn.Gamma[i] = 1
+		bn.RunningVar[i] = 1
+	}
+	bn.InitLearningState()
+	return bn
+}
+
+func (bn *BatchNormLayer) Type() LayerType { return BatchNorm_L }
+func (bn *BatchNormLayer) NumIn() int      { return len(bn.Gamma) }
+func (bn *BatchNormLayer) NumOut() int     { return len(bn.Gamma) }
+
+func (bn *BatchNormLayer) InitLearningState() {
+	bn.gammaGrad = make([]float64, len(bn.Gamma))
+	bn.betaGrad = make([]float64, len(bn.Beta))
+	bn.gammaState = NewOptimizerState(len(bn.Gamma))
+	bn.betaState = NewOptimizerState(len(bn.Beta))
+	bn.invStd = make([]float64, len(bn.Gamma))
+}
+
+func (bn *BatchNormLayer) Parameters() []*Parameter {
+	return []*Parameter{
+		{Values: bn.Gamma, Gradients: bn.gammaGrad, State: bn.gammaState},
+		{Values: bn.Beta, Gradients: bn.betaGrad, State: bn.betaState},
+		{Values: bn.RunningMean},
+		{Values: bn.RunningVar},
+	}
+}
+
+// Forward keeps the normalized inputs of every sample in the learn data
+// cache for backprop. Features are independent, so they are split between
+// the workers. Batches of one sample leave the running statistics alone.
+func (bn *BatchNormLayer) Forward(inputs *Matrix, learnData *LayerLearnData) *Matrix {
+	learnData.allocCache(len(bn.Gamma))
+
+	n := float64(inputs.Rows)
+	parallelFor(len(bn.Gamma), func(j int) {
+		mean := 0.0
+		for s := 0; s < inputs.Rows; s++ {
+			mean += inputs.Row(s)[j]
+		}
+		mean /= n
+
+		variance := 0.0
+		for s := 0; s < inputs.Rows; s++ {
+			d := inputs.Row(s)[j] - mean
+			variance += d * d
+		}
+		variance /= n
+
+		invStd := 1 / math.Sqrt(variance+bn.Epsilon)
+		bn.invStd[j] = invStd
+		for s := 0; s < inputs.Rows; s++ {
+			xHat := (inputs.Row(s)[j] - mean) * invStd
+			learnData.cache.Row(s)[j] = xHat
+			learnData.outputs.Row(s)[j] = bn.Gamma[j]*xHat + bn.Beta[j]
+		}
+
+		// a single sample has no variance to learn from
+		if inputs.Rows < 2 {
+			return
+		}
+		unbiased := variance * n / (n - 1)
+		bn.RunningMean[j] = bn.Momentum*bn.RunningMean[j] + (1-bn.Momentum)*mean
+		bn.RunningVar[j] = bn.Momentum*bn.RunningVar[j] + (1-bn.Momentum)*unbiased
+	})
+
+	return learnData.outputs
+}
+
+func (bn *BatchNormLayer) Backward(outputGradients *Matrix, learnData *LayerLearnData) *Matrix {
+	n := float64(outputGradients.Rows)
+	parallelFor(len(bn.Gamma), func(j int) {
+		sumDy, sumDyXHat := 0.0, 0.0
+		for s := 0; s < outputGradients.Rows; s++ {
+			grad := outputGradients.Row(s)[j]
+			sumDy += grad
+			sumDyXHat += grad * learnData.cache.Row(s)[j]
+		}
+		bn.betaGrad[j] += sumDy
+		bn.gammaGrad[j] += sumDyXHat
+
+		if learnData.inputGradients == nil {
+			return
+		}
+
+		scale := bn.Gamma[j] * bn.invStd[j]
+		for s := 0; s < outputGradients.Rows; s++ {
+			xHat := learnData.cache.Row(s)[j]
+			learnData.inputGradients.Row(s)[j] = scale * (outputGradients.Row(s)[j] - sumDy/n - xHat*sumDyXHat/n)
+		}
+	})
+
+	return learnData.inputGradients
+}
+
+func (bn *BatchNormLayer) CalculateOutputs(inputs []float64) []float64 {
+	outputs := make([]float64, len(inputs))
+	for j := range inputs {
+		xHat := (inputs[j] - bn.RunningMean[j]) / math.Sqrt(bn.RunningVar[j]+bn.Epsilon)
+		outputs[j] = bn.Gamma[j]*xHat + bn.Beta[j]
+	}
+	return outputs
+}
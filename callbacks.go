@@ -0,0 +1,104 @@
+package neuralnetwork
+
+// Callback hooks into the training loop. Embed BaseCallback to only
+// implement the hooks you need.
+type Callback interface {
+	OnTrainBegin(ctx *CallbackContext)
+	OnTrainEnd(ctx *CallbackContext)
+	OnEpochBegin(ctx *CallbackContext)
+	OnEpochEnd(ctx *CallbackContext)
+	OnBatchBegin(ctx *CallbackContext)
+	OnBatchEnd(ctx *CallbackContext)
+	OnEvaluate(ctx *CallbackContext)
+}
+
+// CallbackContext is shared by every hook of a training run. BatchLoss is
+// set after each batch, EpochLoss is the mean batch loss of the epoch so far
+// and Evaluation holds the latest validation results. For regression and
+// multi-label tasks, Regression or MultiLabel holds them instead and
+// Evaluation is nil.
+type CallbackContext struct {
+	Trainer    *Trainer
+	Epoch      int
+	Batch      int
+	NumBatches int
+	Rate       float64
+	BatchLoss  float64
+	EpochLoss  float64
+	Evaluation *EvaluationData
+	Regression *RegressionEvaluation
+	MultiLabel *MultiLabelEvaluation
+
+	// Resumed is set when the run continues from a checkpoint.
+	Resumed bool
+
+	epochLossSum   float64
+	validationLoss func() float64
+	valLoss        float64
+	valLossEpoch   int
+	stop           bool
+}
+
+// StopTraining ends the run after the current hook returns.
+func (ctx *CallbackContext) StopTraining() {
+	ctx.stop = true
+}
+
+// ValidationLoss returns the mean loss over the validation data, computed at
+// most once per epoch.
+func (ctx *CallbackContext) ValidationLoss() float64 {
+	if ctx.valLossEpoch != ctx.Epoch {
+		ctx.valLoss = ctx.validationLoss()
+		ctx.valLossEpoch = ctx.Epoch
+	}
+	return ctx.valLoss
+}
+
+// score is the latest validation metric where higher is better: accuracy,
+// R² for regression or subset accuracy for multi-label tasks.
+func (ctx *CallbackContext) score() float64 {
+	switch {
+	case ctx.Regression != nil:
+		return ctx.Regression.R2
+	case ctx.MultiLabel != nil:
+		return ctx.MultiLabel.SubsetAccuracy
+	}
+	return ctx.Evaluation.GettAccuracy()
+}
+
+type BaseCallback struct{}
+
+func (BaseCallback) OnTrainBegin(ctx *CallbackContext) {}
+func (BaseCallback) OnTrainEnd(ctx *CallbackContext)   {}
+func (BaseCallback) OnEpochBegin(ctx *CallbackContext) {}
+func (BaseCallback) OnEpochEnd(ctx *CallbackContext)   {}
+func (BaseCallback) OnBatchBegin(ctx *CallbackContext) {}
+func (BaseCallback) OnBatchEnd(ctx *CallbackContext)   {}
+func (BaseCallback) OnEvaluate(ctx *CallbackContext)   {}
+
+// EpochEndCallback adapts a plain function, like TrainerConf.OnEpochComplete.
+type EpochEndCallback struct {
+	BaseCallback
+	Fn func(epochIndex int, evaluation *EvaluationData, EpochLoss float64)
+}
+
+func (c EpochEndCallback) OnEpochEnd(ctx *CallbackContext) {
+	c.Fn(ctx.Epoch, ctx.Evaluation, ctx.EpochLoss)
+}
+
+// callbacks lists the configured hooks: OnEpochComplete first, then the user
+// callbacks, then early stopping and checkpointing.
+func (t *Trainer) callbacks() []Callback {
+	callbacks := []Callback{}
+	if t.Config.OnEpochComplete != nil {
+		callbacks = append(callbacks, EpochEndCallback{Fn: t.Config.OnEpochComplete})
+	}
+	callbacks = append(callbacks, t.Config.Callbacks...)
+	if t.Config.EarlyStopping != nil {
+		callbacks = append(callbacks, NewEarlyStopping(*t.Config.EarlyStopping))
+	}
+	if t.Config.Checkpoint != nil {
+		callbacks = append(callbacks, NewCheckpointer(*t.Config.Checkpoint))
+	}
+	return callbacks
+}
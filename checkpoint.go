@@ -0,0 +1,220 @@
+package neuralnetwork
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// CheckpointConf saves a checkpoint into Dir every EveryEpochs epochs and/or
+// every EveryBatches batches, keeping only the KeepLast most recent ones
+// (all of them when KeepLast is 0).
+type CheckpointConf struct {
+	Dir          string
+	EveryEpochs  int
+	EveryBatches int
+	KeepLast     int
+}
+
+// Checkpoint holds everything needed to continue an interrupted run. Epoch
+// and Batch are the position training resumes at, EpochLoss the summed batch
+// loss of the epoch so far. RNGState is the state the batches of Epoch are
+// drawn from, so the sampler draws them again on resume. DropoutRNGState is
+// where the network's dropout masks go on from.
+type Checkpoint struct {
+	Network         *NeuralNetwork      `json:"network"`
+	OptimizerState  [][]*OptimizerState `json:"optimizer_state"`
+	Epoch           int                 `json:"epoch"`
+	Batch           int                 `json:"batch"`
+	EpochLoss       float64             `json:"epoch_loss"`
+	Rate            float64             `json:"rate"`
+	RNGState        uint64              `json:"rng_state"`
+	DropoutRNGState uint64              `json:"dropout_rng_state"`
+	EarlyStopping   *EarlyStoppingState `json:"early_stopping,omitempty"`
+}
+
+type EarlyStoppingState struct {
+	Best       float64     `json:"best"`
+	BestEpoch  int         `json:"best_epoch"`
+	Wait       int         `json:"wait"`
+	BestParams [][]float64 `json:"best_params,omitempty"`
+}
+
+const checkpointPattern = "checkpoint-*.json"
+
+// Checkpointer saves checkpoints as configured by a CheckpointConf.
+type Checkpointer struct {
+	BaseCallback
+	conf CheckpointConf
+}
+
+func NewCheckpointer(conf CheckpointConf) *Checkpointer {
+	return &Checkpointer{conf: conf}
+}
+
+func (c *Checkpointer) OnBatchEnd(ctx *CallbackContext) {
+	nextBatch := ctx.Batch + 1
+	if c.conf.EveryBatches <= 0 || nextBatch == ctx.NumBatches || nextBatch%c.conf.EveryBatches != 0 {
+		return
+	}
+	c.save(ctx.Trainer, ctx.Epoch, nextBatch, ctx.epochLossSum, ctx.Rate)
+}
+
+func (c *Checkpointer) OnEpochEnd(ctx *CallbackContext) {
+	nextEpoch := ctx.Epoch + 1
+	if c.conf.EveryEpochs <= 0 || nextEpoch%c.conf.EveryEpochs != 0 {
+		return
+	}
+	c.save(ctx.Trainer, nextEpoch, 0, 0, ctx.Rate)
+}
+
+func (c *Checkpointer) save(t *Trainer, epoch, batch int, epochLoss, rate float64) {
+	name := fmt.Sprintf("checkpoint-e%04d-b%06d.json", epoch, batch)
+	path := filepath.Join(c.conf.Dir, name)
+
+	if err := t.writeCheckpoint(path, epoch, batch, epochLoss, rate); err != nil {
+		println("[WARN] Checkpoint failed :", err.Error())
+		return
+	}
+	if err := pruneCheckpoints(c.conf.Dir, c.conf.KeepLast); err != nil {
+		println("[WARN] Checkpoint cleanup failed :", err.Error())
+	}
+}
+
+// writeCheckpoint writes the full training state, to be resumed at the given
+// epoch and batch. The file is written atomically.
+func (t *Trainer) writeCheckpoint(path string, epoch, batch int, epochLoss, rate float64) error {
+	cp := Checkpoint{
+		Network:   t.NN,
+		Epoch:     epoch,
+		Batch:     batch,
+		EpochLoss: epochLoss,
+		Rate:      rate,
+		RNGState:  t.rngSource.state,
+	}
+	t.NN.ensureRNG()
+	cp.DropoutRNGState = t.NN.rngSource.state
+	// mid-epoch, the current epoch's batches have to be drawn again
+	if batch > 0 {
+		cp.RNGState = t.epochRNGState
+	}
+	cp.OptimizerState = t.NN.optimizerStates()
+	if es := t.earlyStopping(); es != nil {
+		cp.EarlyStopping = es.state()
+	}
+
+	jsonData, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, jsonData, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ResumeFromCheckpoint restores the network, optimizer state, schedule
+// position and history from a checkpoint. Training data must be loaded the
+// same way as in the interrupted run; the next Train or IncTrain call picks
+// up where it left off.
+func (t *Trainer) ResumeFromCheckpoint(path string) error {
+	jsonData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	cp := &Checkpoint{}
+	if err := json.Unmarshal(jsonData, cp); err != nil {
+		return err
+	}
+
+	nn := cp.Network
+	if nn == nil {
+		return fmt.Errorf("invalid checkpoint %s", path)
+	}
+	if err := nn.setOptimizerStates(cp.OptimizerState); err != nil {
+		return err
+	}
+
+	t.NN = nn
+	t.NN.SetOptimizer(t.newOptimizer())
+	t.History = nn.History
+
+	t.rngSource.state = cp.RNGState
+	nn.setRNGState(cp.DropoutRNGState)
+
+	// stateful schedulers only depend on the scores they were fed
+	if scheduler, ok := t.Config.Scheduler.(IMetricScheduler); ok {
+		scheduler.Reset()
+		for _, score := range t.History.scores() {
+			scheduler.Observe(score)
+		}
+	}
+
+	t.resumed = cp
+	return nil
+}
+
+// LatestCheckpoint returns the most recent checkpoint saved in dir.
+func LatestCheckpoint(dir string) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, checkpointPattern))
+	if err != nil {
+		return "", err
+	}
+	if len(paths) == 0 {
+		return "", fmt.Errorf("no checkpoint in %s", dir)
+	}
+	sort.Strings(paths)
+	return paths[len(paths)-1], nil
+}
+
+func pruneCheckpoints(dir string, keepLast int) error {
+	if keepLast <= 0 {
+		return nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, checkpointPattern))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	for len(paths) > keepLast {
+		if err := os.Remove(paths[0]); err != nil {
+			return err
+		}
+		paths = paths[1:]
+	}
+	return nil
+}
+
+func (es *EarlyStopping) state() *EarlyStoppingState {
+	st := &EarlyStoppingState{
+		BestEpoch:  es.bestEpoch,
+		Wait:       es.wait,
+		BestParams: es.bestParams,
+	}
+	// JSON has no infinities, the initial best is rebuilt on restore
+	if !math.IsInf(es.best, 0) {
+		st.Best = es.best
+	}
+	return st
+}
+
+func (es *EarlyStopping) restoreState(st *EarlyStoppingState) {
+	if st.BestEpoch >= 0 {
+		es.best = st.Best
+	}
+	es.bestEpoch = st.BestEpoch
+	es.wait = st.Wait
+	es.bestParams = st.BestParams
+}
@@ -0,0 +1,238 @@
+package neuralnetwork
+
+import "math/rand"
+
+// Shape describes image-like data, stored flat in channel, row, column order.
+type Shape struct {
+	Channels int `json:"channels"`
+	Height   int `json:"height"`
+	Width    int `json:"width"`
+}
+
+func FlatShape(size int) Shape {
+	return Shape{Channels: 1, Height: 1, Width: size}
+}
+
+func (s Shape) Size() int {
+	return s.Channels * s.Height * s.Width
+}
+
+func (s Shape) index(c, y, x int) int {
+	return (c*s.Height+y)*s.Width + x
+}
+
+// Conv2DLayer slides Filters kernels of KernelSize x KernelSize over its
+// input, each spanning all input channels.
+type Conv2DLayer struct {
+	InShape    Shape `json:"in_shape"`
+	OutShape   Shape `json:"out_shape"`
+	KernelSize int   `json:"kernel_size"`
+	Stride     int   `json:"stride"`
+	Padding    int   `json:"padding"`
+
+	// Weights are laid out as [filter][in channel][row][column].
+	Weights []float64 `json:"weights"`
+	Biases  []float64 `json:"biases"`
+
+	Activation      ActivationType `json:"activation"`
+	ActivationAlpha float64        `json:"activation_alpha,omitempty"`
+	// Slopes are the learned PReLU slopes, one per filter.
+	Slopes []float64 `json:"slopes,omitempty"`
+	// Init is how the weights were initialized, nil for networks saved
+	// before it was recorded.
+	Init *InitConf `json:"init,omitempty"`
+
+	lossGradientW, lossGradientB []float64
+	weightState, biasState       *OptimizerState
+
+	ActivationFn IActivation `json:"-"`
+}
+
+func NewConv2DLayer(inShape Shape, filters, kernelSize, stride, padding int, rng *rand.Rand) *Conv2DLayer {
+	l := newConv2DLayer(inShape, filters, kernelSize, stride, padding)
+	l.InitializeWeights(InitConf{Type: LeCunNormal_I}, rng)
+	return l
+}
+
+// newConv2DLayer leaves the weights to be initialized.
+func newConv2DLayer(inShape Shape, filters, kernelSize, stride, padding int) *Conv2DLayer {
+	if stride <= 0 {
+		stride = 1
+	}
+
+	l := &Conv2DLayer{
+		InShape:    inShape,
+		KernelSize: kernelSize,
+		Stride:     stride,
+		Padding:    padding,
+	}
+	l.OutShape = Shape{
+		Channels: filters,
+		Height:   (inShape.Height+2*padding-kernelSize)/stride + 1,
+		Width:    (inShape.Width+2*padding-kernelSize)/stride + 1,
+	}
+	assert(l.OutShape.Height > 0 && l.OutShape.Width > 0, "convolution kernel is larger than its input")
+
+	l.Weights = make([]float64, filters*inShape.Channels*kernelSize*kernelSize)
+	l.Biases = make([]float64, filters)
+
+	l.InitLearningState()
+	return l
+}
+
+// InitializeWeights resets the weights and biases, picking the scheme from
+// the activation for Auto_I, and records the scheme in Init. Every filter
+// sees InShape.Channels kernels.
+func (l *Conv2DLayer) InitializeWeights(conf InitConf, rng *rand.Rand) {
+	conf = conf.resolved(l.Activation)
+	taps := l.KernelSize * l.KernelSize
+	initializeParams(conf, l.Weights, l.Biases, l.InShape.Channels*taps, l.OutShape.Channels*taps, rng)
+	l.Init = &conf
+}
+
+func (l *Conv2DLayer) Type() LayerType { return Conv2D_L }
+func (l *Conv2DLayer) NumIn() int      { return l.InShape.Size() }
+func (l *Conv2DLayer) NumOut() int     { return l.OutShape.Size() }
+
+func (l *Conv2DLayer) InitLearningState() {
+	l.lossGradientW = make([]float64, len(l.Weights))
+	l.lossGradientB = make([]float64, len(l.Biases))
+
+	l.weightState = NewOptimizerState(len(l.Weights))
+	l.biasState = NewOptimizerState(len(l.Biases))
+}
+
+func (l *Conv2DLayer) Parameters() []*Parameter {
+	params := []*Parameter{
+		{Values: l.Weights, Gradients: l.lossGradientW, State: l.weightState, Decay: true},
+		{Values: l.Biases, Gradients: l.lossGradientB, State: l.biasState},
+	}
+	return append(params, activationParameters(l.ActivationFn)...)
+}
+
+func (l *Conv2DLayer) SetActivation(act ActivationType) {
+	l.Activation = act
+	l.ActivationFn = layerActivation(act, l.ActivationAlpha, &l.Slopes, l.OutShape.Channels, l.OutShape.Height*l.OutShape.Width)
+}
+
+func (l *Conv2DLayer) weightIndex(f, c, ky, kx int) int {
+	return ((f*l.InShape.Channels+c)*l.KernelSize+ky)*l.KernelSize + kx
+}
+
+// eachTap calls fn for every kernel tap of output position (oy, ox) that
+// falls inside the input, skipping the zero padding.
+func (l *Conv2DLayer) eachTap(oy, ox int, fn func(ky, kx, iy, ix int)) {
+	for ky := 0; ky < l.KernelSize; ky++ {
+		iy := oy*l.Stride + ky - l.Padding
+		if iy < 0 || iy >= l.InShape.Height {
+			continue
+		}
+		for kx := 0; kx < l.KernelSize; kx++ {
+			ix := ox*l.Stride + kx - l.Padding
+			if ix < 0 || ix >= l.InShape.Width {
+				continue
+			}
+			fn(ky, kx, iy, ix)
+		}
+	}
+}
+
+func (l *Conv2DLayer) activationType() ActivationType { return l.Activation }
+
+func (l *Conv2DLayer) calculateWeightedInputs(inputs, weightedInputs []float64) {
+	out := l.OutShape
+	for f := 0; f < out.Channels; f++ {
+		for oy := 0; oy < out.Height; oy++ {
+			for ox := 0; ox < out.Width; ox++ {
+				sum := l.Biases[f]
+				for c := 0; c < l.InShape.Channels; c++ {
+					l.eachTap(oy, ox, func(ky, kx, iy, ix int) {
+						sum += l.Weights[l.weightIndex(f, c, ky, kx)] * inputs[l.InShape.index(c, iy, ix)]
+					})
+				}
+				weightedInputs[out.index(f, oy, ox)] = sum
+			}
+		}
+	}
+}
+
+func (l *Conv2DLayer) CalculateOutputs(inputs []float64) []float64 {
+	weightedInputs := make([]float64, l.NumOut())
+	l.calculateWeightedInputs(inputs, weightedInputs)
+
+	activations := make([]float64, l.NumOut())
+	l.ActivationFn.Activate(weightedInputs, activations)
+	return activations
+}
+
+func (l *Conv2DLayer) Forward(inputs *Matrix, learnData *LayerLearnData) *Matrix {
+	learnData.inputs = inputs
+	learnData.allocCache(l.NumOut())
+
+	parallelFor(inputs.Rows, func(s int) {
+		weightedInputs := learnData.cache.Row(s)
+		l.calculateWeightedInputs(inputs.Row(s), weightedInputs)
+
+		l.ActivationFn.Activate(weightedInputs, learnData.outputs.Row(s))
+	})
+
+	return learnData.outputs
+}
+
+// Backward accumulates the parameter gradients of each worker's samples in
+// its own buffer, reduced into the layer gradients once all are done.
+func (l *Conv2DLayer) Backward(outputGradients *Matrix, learnData *LayerLearnData) *Matrix {
+	out := l.OutShape
+	if !learnData.logitGradients {
+		accumulateActivationGradients(l.ActivationFn, learnData.cache, outputGradients)
+		parallelFor(outputGradients.Rows, func(s int) {
+			nodeValues := outputGradients.Row(s)
+			l.ActivationFn.Backward(learnData.cache.Row(s), learnData.outputs.Row(s), nodeValues, nodeValues)
+		})
+	}
+
+	learnData.accumulate(outputGradients.Rows, func(buffer []float64, start, end int) {
+		gradW, gradB := buffer[:len(l.Weights)], buffer[len(l.Weights):]
+		for s := start; s < end; s++ {
+			nodeValues, inputs := outputGradients.Row(s), learnData.inputs.Row(s)
+			for f := 0; f < out.Channels; f++ {
+				for oy := 0; oy < out.Height; oy++ {
+					for ox := 0; ox < out.Width; ox++ {
+						nodeValue := nodeValues[out.index(f, oy, ox)]
+						gradB[f] += nodeValue
+						for c := 0; c < l.InShape.Channels; c++ {
+							l.eachTap(oy, ox, func(ky, kx, iy, ix int) {
+								gradW[l.weightIndex(f, c, ky, kx)] += inputs[l.InShape.index(c, iy, ix)] * nodeValue
+							})
+						}
+					}
+				}
+			}
+		}
+	}, l.lossGradientW, l.lossGradientB)
+
+	if learnData.inputGradients == nil {
+		return nil
+	}
+
+	parallelFor(outputGradients.Rows, func(s int) {
+		nodeValues, inputGradients := outputGradients.Row(s), learnData.inputGradients.Row(s)
+		for i := range inputGradients {
+			inputGradients[i] = 0
+		}
+		for f := 0; f < out.Channels; f++ {
+			for oy := 0; oy < out.Height; oy++ {
+				for ox := 0; ox < out.Width; ox++ {
+					nodeValue := nodeValues[out.index(f, oy, ox)]
+					for c := 0; c < l.InShape.Channels; c++ {
+						l.eachTap(oy, ox, func(ky, kx, iy, ix int) {
+							inputGradients[l.InShape.index(c, iy, ix)] += l.Weights[l.weightIndex(f, c, ky, kx)] * nodeValue
+						})
+					}
+				}
+			}
+		}
+	})
+
+	return learnData.inputGradients
+}
@@ -0,0 +1,197 @@
+package neuralnetwork
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// StratifiedSplit splits data into training, validation and test sets
+// holding the same class proportions as data. The test set gets what the
+// first two fractions leave, so a trainingSplit and validationSplit summing to
+// 1 make a plain training/validation split.
+func StratifiedSplit(data []DataPoint, trainingSplit, validationSplit float64) (training, validation, test []DataPoint) {
+	return stratifiedSplit(dataRand, data, trainingSplit, validationSplit)
+}
+
+func stratifiedSplit(rng *rand.Rand, data []DataPoint, trainingSplit, validationSplit float64) (training, validation, test []DataPoint) {
+	assert(trainingSplit >= 0 && validationSplit >= 0 && trainingSplit+validationSplit <= 1, "invalid split fractions")
+
+	for _, class := range classIndices(dataLabels(data)) {
+		shuffleWith(rng, class)
+		numTraining := int(math.Round(float64(len(class)) * trainingSplit))
+		numValidation := minInt(int(math.Round(float64(len(class))*validationSplit)), len(class)-numTraining)
+		for i, index := range class {
+			switch {
+			case i < numTraining:
+				training = append(training, data[index])
+			case i < numTraining+numValidation:
+				validation = append(validation, data[index])
+			default:
+				test = append(test, data[index])
+			}
+		}
+	}
+
+	// the sets come out grouped by class
+	shuffleWith(rng, training)
+	shuffleWith(rng, validation)
+	shuffleWith(rng, test)
+	return training, validation, test
+}
+
+// StratifiedFolds deals data into k folds of about the same size and class
+// proportions.
+func StratifiedFolds(data []DataPoint, k int) [][]DataPoint {
+	return stratifiedFolds(dataRand, data, k)
+}
+
+func stratifiedFolds(rng *rand.Rand, data []DataPoint, k int) [][]DataPoint {
+	assert(k >= 2 && k <= len(data), "need between 2 and len(data) folds")
+
+	folds := make([][]DataPoint, k)
+	fold := 0
+	for _, class := range classIndices(dataLabels(data)) {
+		shuffleWith(rng, class)
+		for _, index := range class {
+			folds[fold] = append(folds[fold], data[index])
+			fold = (fold + 1) % k
+		}
+	}
+	for _, f := range folds {
+		shuffleWith(rng, f)
+	}
+	return folds
+}
+
+func dataLabels(data []DataPoint) []int {
+	labels := make([]int, len(data))
+	for i, dp := range data {
+		labels[i] = dp.label
+	}
+	return labels
+}
+
+// FoldResult is the validation of the network trained on the other folds.
+// Only the evaluation of the configured task is set.
+type FoldResult struct {
+	Evaluation *EvaluationData       `json:"-"`
+	Regression *RegressionEvaluation `json:"regression,omitempty"`
+	MultiLabel *MultiLabelEvaluation `json:"multi_label,omitempty"`
+	Metrics    map[string]float64    `json:"metrics"`
+	NN         *NeuralNetwork        `json:"-"`
+}
+
+// CrossValidation holds the results of every fold, and the mean and standard
+// deviation of their metrics.
+type CrossValidation struct {
+	Folds []FoldResult       `json:"folds"`
+	Mean  map[string]float64 `json:"mean"`
+	Std   map[string]float64 `json:"std"`
+}
+
+// CrossValidate runs k-fold cross-validation: for every fold it trains a
+// fresh network from nnConf and tConf on the other folds and validates it on
+// that one. Folds are stratified by label. Every fold saves its checkpoints
+// in its own directory. Callbacks in tConf are shared by the folds, so they
+// should not keep state between runs. tConf.Seed also drives the folds.
+func CrossValidate(data []DataPoint, k int, nnConf NNConf, tConf TrainerConf) *CrossValidation {
+	folds := stratifiedFolds(newRand(tConf.Seed), data, k)
+	cv := &CrossValidation{}
+
+	for i, validation := range folds {
+		println(fmt.Sprintf("[INFO] Cross-validation fold %d / %d", i+1, k))
+		training := []DataPoint{}
+		for j, fold := range folds {
+			if j != i {
+				training = append(training, fold...)
+			}
+		}
+
+		foldConf := tConf
+		if tConf.Checkpoint != nil {
+			checkpoint := *tConf.Checkpoint
+			checkpoint.Dir = filepath.Join(checkpoint.Dir, fmt.Sprintf("fold-%d", i))
+			foldConf.Checkpoint = &checkpoint
+		}
+
+		t := NewTrainer(foldConf)
+		t.NNInit(nnConf)
+		t.LoadCustomData(training, validation)
+		t.Train()
+		cv.Folds = append(cv.Folds, t.validateFold())
+	}
+
+	cv.aggregate()
+	return cv
+}
+
+// validateFold evaluates the trained network on the validation data.
+func (t *Trainer) validateFold() FoldResult {
+	result := FoldResult{NN: t.NN, Metrics: map[string]float64{}}
+	result.Metrics["loss"] = t.NN.calculateTotalLoss(t.validationData) / float64(len(t.validationData))
+
+	switch t.Config.Task {
+	case ClassificationTask:
+		result.Evaluation = t.Eval(true)
+		result.Metrics["accuracy"] = result.Evaluation.GettAccuracy() / 100
+		result.Metrics["macro_f1"] = result.Evaluation.MacroAverage().F1
+		result.Metrics["weighted_f1"] = result.Evaluation.WeightedAverage().F1
+	case RegressionTask:
+		result.Regression = t.EvalRegression(true)
+		result.Metrics["mse"] = result.Regression.MSE
+		result.Metrics["rmse"] = result.Regression.RMSE
+		result.Metrics["mae"] = result.Regression.MAE
+		result.Metrics["r2"] = result.Regression.R2
+	case MultiLabelTask:
+		result.MultiLabel = t.EvalMultiLabel(true)
+		result.Metrics["subset_accuracy"] = result.MultiLabel.SubsetAccuracy
+		result.Metrics["hamming_loss"] = result.MultiLabel.HammingLoss
+		result.Metrics["micro_f1"] = result.MultiLabel.MicroF1
+		result.Metrics["macro_f1"] = result.MultiLabel.MacroF1
+	default:
+		panic("Unhandled task type")
+	}
+	return result
+}
+
+// aggregate computes the mean and sample standard deviation of every metric
+// over the folds.
+func (cv *CrossValidation) aggregate() {
+	cv.Mean, cv.Std = map[string]float64{}, map[string]float64{}
+	n := float64(len(cv.Folds))
+
+	for name := range cv.Folds[0].Metrics {
+		sum := 0.0
+		for _, fold := range cv.Folds {
+			sum += fold.Metrics[name]
+		}
+		mean := sum / n
+
+		squares := 0.0
+		for _, fold := range cv.Folds {
+			diff := fold.Metrics[name] - mean
+			squares += diff * diff
+		}
+		cv.Mean[name] = mean
+		cv.Std[name] = math.Sqrt(squares / (n - 1))
+	}
+}
+
+func (cv *CrossValidation) GetSummaryString() string {
+	names := []string{}
+	for name := range cv.Mean {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%d-fold cross-validation\n", len(cv.Folds)))
+	for _, name := range names {
+		sb.WriteString(fmt.Sprintf("%16s : %.4f ± %.4f\n", name, cv.Mean[name], cv.Std[name]))
+	}
+	return sb.String()
+}
@@ -6,7 +6,6 @@ import (
 	_ "image/png"
 	"math/rand"
 	"os"
-	"time"
 )
 
 type DataPoint struct {
@@ -37,12 +36,55 @@ func NewDataPoint(inputs []float64, label, numLabels int) DataPoint {
 	return dp
 }
 
+// NewRegressionDataPoint uses targets as the expected outputs. The point has
+// no label, so it can't be evaluated for accuracy.
+func NewRegressionDataPoint(inputs, targets []float64) DataPoint {
+	return DataPoint{
+		inputs:          inputs,
+		expectedOutputs: targets,
+		label:           -1,
+	}
+}
+
+// NewMultiLabelDataPoint expects every one of labels at once, as a multi-hot
+// vector. Like regression points, it has no single label.
+func NewMultiLabelDataPoint(inputs []float64, labels []int, numLabels int) DataPoint {
+	dp := DataPoint{
+		inputs:          inputs,
+		expectedOutputs: make([]float64, numLabels),
+		label:           -1,
+	}
+	for _, label := range labels {
+		dp.expectedOutputs[label] = 1
+	}
+	return dp
+}
+
 func (dp *DataPoint) createOneHot(index, num int) []float64 {
 	oneHot := make([]float64, num)
 	oneHot[index] = 1
 	return oneHot
 }
 
+// BalancedClassWeights weighs every class by n / (numLabels * count), so each
+// class contributes as much to the loss as if they were all equally frequent.
+// Classes missing from labels keep a weight of 1.
+func BalancedClassWeights(labels []int, numLabels int) []float64 {
+	counts := make([]int, numLabels)
+	for _, label := range labels {
+		counts[label]++
+	}
+
+	weights := make([]float64, numLabels)
+	for i, count := range counts {
+		weights[i] = 1
+		if count > 0 {
+			weights[i] = float64(len(labels)) / float64(numLabels*count)
+		}
+	}
+	return weights
+}
+
 func NewBatch(data []DataPoint) *Batch {
 	return &Batch{data: data}
 }
@@ -68,7 +110,11 @@ func CreateMiniBatches(data []DataPoint, batchSize int) []Batch {
 }
 
 func SplitData[T any](allData []T, trainingSplit float64) ([]T, []T) {
-	ShuffleBatches(allData)
+	return splitData(dataRand, allData, trainingSplit)
+}
+
+func splitData[T any](rng *rand.Rand, allData []T, trainingSplit float64) ([]T, []T) {
+	shuffleWith(rng, allData)
 
 	totalLength := len(allData)
 	trainingLength := int(float64(totalLength) * trainingSplit)
@@ -77,12 +123,7 @@ func SplitData[T any](allData []T, trainingSplit float64) ([]T, []T) {
 }
 
 func ShuffleBatches[T any](batches []T) {
-	rand.Seed(time.Now().UnixNano())
-
-	for i := len(batches) - 1; i > 0; i-- {
-		j := rand.Intn(i + 1)
-		batches[i], batches[j] = batches[j], batches[i]
-	}
+	shuffleWith(dataRand, batches)
 }
 
 func LoadMNISTData(imPath, labPath string) []DataPoint {
@@ -0,0 +1,158 @@
+package neuralnetwork
+
+import "math/rand"
+
+type DenseLayer struct {
+	NumNIn  int `json:"num_nodes_in"`
+	NumNOut int `json:"num_nodes_out"`
+
+	Weights []float64 `json:"weights"`
+	Biases  []float64 `json:"biases"`
+
+	Activation      ActivationType `json:"activation"`
+	ActivationAlpha float64        `json:"activation_alpha,omitempty"`
+	// Slopes are the learned PReLU slopes, one per output node.
+	Slopes []float64 `json:"slopes,omitempty"`
+	// Init is how the weights were initialized, nil for networks saved
+	// before it was recorded.
+	Init *InitConf `json:"init,omitempty"`
+
+	lossGradientW, lossGradientB []float64       `json:"-"`
+	weightState, biasState       *OptimizerState `json:"-"`
+
+	ActivationFn IActivation `json:"-"`
+}
+
+func NewDenseLayer(numIn, numOut int, rng *rand.Rand) *DenseLayer {
+	l := newDenseLayer(numIn, numOut)
+	l.InitializeRandomWeights(rng)
+	return l
+}
+
+// newDenseLayer leaves the weights to be initialized.
+func newDenseLayer(numIn, numOut int) *DenseLayer {
+	l := &DenseLayer{
+		NumNIn: numIn, NumNOut: numOut,
+	}
+	l.Weights = make([]float64, numIn*numOut)
+	l.Biases = make([]float64, numOut)
+
+	l.InitLearningState()
+	return l
+}
+
+func (l *DenseLayer) Type() LayerType { return Dense_L }
+func (l *DenseLayer) NumIn() int      { return l.NumNIn }
+func (l *DenseLayer) NumOut() int     { return l.NumNOut }
+
+func (l *DenseLayer) InitLearningState() {
+	l.lossGradientW = make([]float64, len(l.Weights))
+	l.lossGradientB = make([]float64, len(l.Biases))
+
+	l.weightState = NewOptimizerState(len(l.Weights))
+	l.biasState = NewOptimizerState(len(l.Biases))
+}
+
+func (l *DenseLayer) Parameters() []*Parameter {
+	params := []*Parameter{
+		{Values: l.Weights, Gradients: l.lossGradientW, State: l.weightState, Decay: true},
+		{Values: l.Biases, Gradients: l.lossGradientB, State: l.biasState},
+	}
+	return append(params, activationParameters(l.ActivationFn)...)
+}
+
+func (l *DenseLayer) SetActivation(act ActivationType) {
+	l.Activation = act
+	l.ActivationFn = layerActivation(act, l.ActivationAlpha, &l.Slopes, l.NumNOut, 1)
+}
+
+func (l *DenseLayer) InitializeRandomWeights(rng *rand.Rand) {
+	l.InitializeWeights(InitConf{Type: LeCunNormal_I}, rng)
+}
+
+// InitializeWeights resets the weights and biases, picking the scheme from
+// the activation for Auto_I, and records the scheme in Init.
+func (l *DenseLayer) InitializeWeights(conf InitConf, rng *rand.Rand) {
+	conf = conf.resolved(l.Activation)
+	initializeParams(conf, l.Weights, l.Biases, l.NumNIn, l.NumNOut, rng)
+	l.Init = &conf
+}
+
+// weightMatrix views the weights as a NumNOut x NumNIn matrix.
+func (l *DenseLayer) weightMatrix() *Matrix {
+	return &Matrix{Rows: l.NumNOut, Cols: l.NumNIn, Data: l.Weights}
+}
+
+// Forward computes the weighted inputs of the whole batch as one matrix
+// product and keeps them in the learn data cache for the activation
+// derivative.
+func (l *DenseLayer) Forward(inputs *Matrix, learnData *LayerLearnData) *Matrix {
+	learnData.inputs = inputs
+	learnData.allocCache(l.NumNOut)
+
+	weightedInputs := learnData.cache
+	gemmABt(inputs, l.weightMatrix(), weightedInputs, false)
+
+	parallelFor(inputs.Rows, func(s int) {
+		weighted := weightedInputs.Row(s)
+		for i := range weighted {
+			weighted[i] += l.Biases[i]
+		}
+		l.ActivationFn.Activate(weighted, learnData.outputs.Row(s))
+	})
+
+	return learnData.outputs
+}
+
+// Backward turns the output gradients into node values in place, then gets
+// the weight gradients as nodeValuesᵀ * inputs and the input gradients as
+// nodeValues * weights.
+func (l *DenseLayer) Backward(outputGradients *Matrix, learnData *LayerLearnData) *Matrix {
+	if !learnData.logitGradients {
+		accumulateActivationGradients(l.ActivationFn, learnData.cache, outputGradients)
+		parallelFor(outputGradients.Rows, func(s int) {
+			nodeValues := outputGradients.Row(s)
+			l.ActivationFn.Backward(learnData.cache.Row(s), learnData.outputs.Row(s), nodeValues, nodeValues)
+		})
+	}
+
+	nodeValuesT := learnData.transpose(0, outputGradients)
+	inputsT := learnData.transpose(1, learnData.inputs)
+	gemmABt(nodeValuesT, inputsT, &Matrix{Rows: l.NumNOut, Cols: l.NumNIn, Data: l.lossGradientW}, true)
+
+	parallelFor(l.NumNOut, func(nodeOut int) {
+		for _, nodeValue := range nodeValuesT.Row(nodeOut) {
+			l.lossGradientB[nodeOut] += nodeValue
+		}
+	})
+
+	if learnData.inputGradients == nil {
+		return nil
+	}
+	weightsT := learnData.transpose(2, l.weightMatrix())
+	gemmABt(outputGradients, weightsT, learnData.inputGradients, false)
+	return learnData.inputGradients
+}
+
+func (l *DenseLayer) activationType() ActivationType { return l.Activation }
+
+func (l *DenseLayer) calculateWeightedInputs(inputs, weightedInputs []float64) {
+	weights := l.weightMatrix()
+	for nodeOut := 0; nodeOut < l.NumNOut; nodeOut++ {
+		weightedInput := l.Biases[nodeOut]
+		for nodeIn, weight := range weights.Row(nodeOut) {
+			weightedInput += inputs[nodeIn] * weight
+		}
+		weightedInputs[nodeOut] = weightedInput
+	}
+}
+
+func (l *DenseLayer) CalculateOutputs(inputs []float64) []float64 {
+	weightedInputs := make([]float64, l.NumNOut)
+	l.calculateWeightedInputs(inputs, weightedInputs)
+
+	activations := make([]float64, l.NumNOut)
+	l.ActivationFn.Activate(weightedInputs, activations)
+
+	return activations
+}
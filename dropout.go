@@ -0,0 +1,52 @@
+package neuralnetwork
+
+// DropoutLayer zeroes its inputs with probability Rate during training and
+// scales the kept ones, so it passes values through untouched at inference.
+type DropoutLayer struct {
+	Size int     `json:"size"`
+	Rate float64 `json:"rate"`
+}
+
+func NewDropoutLayer(size int, rate float64) *DropoutLayer {
+	assert(rate >= 0 && rate < 1, "dropout rate must be in [0, 1)")
+	return &DropoutLayer{Size: size, Rate: rate}
+}
+
+func (l *DropoutLayer) Type() LayerType          { return Dropout_L }
+func (l *DropoutLayer) NumIn() int               { return l.Size }
+func (l *DropoutLayer) NumOut() int              { return l.Size }
+func (l *DropoutLayer) Parameters() []*Parameter { return nil }
+func (l *DropoutLayer) InitLearningState()       {}
+
+func (l *DropoutLayer) CalculateOutputs(inputs []float64) []float64 {
+	return append([]float64(nil), inputs...)
+}
+
+// Forward draws a mask per sample, holding 0 for dropped nodes and the
+// inverted dropout scale for kept ones.
+func (l *DropoutLayer) Forward(inputs *Matrix, learnData *LayerLearnData) *Matrix {
+	learnData.allocCache(l.Size)
+
+	scale := 1 / (1 - l.Rate)
+	mask := learnData.cache.Data
+	for i, in := range inputs.Data {
+		mask[i] = 0
+		if learnData.rng.Float64() >= l.Rate {
+			mask[i] = scale
+		}
+		learnData.outputs.Data[i] = in * mask[i]
+	}
+
+	return learnData.outputs
+}
+
+func (l *DropoutLayer) Backward(outputGradients *Matrix, learnData *LayerLearnData) *Matrix {
+	if learnData.inputGradients == nil {
+		return nil
+	}
+
+	for i, grad := range outputGradients.Data {
+		learnData.inputGradients.Data[i] = grad * learnData.cache.Data[i]
+	}
+	return learnData.inputGradients
+}
@@ -0,0 +1,112 @@
+package neuralnetwork
+
+import "math"
+
+type MetricType int
+
+const (
+	ValidationLoss MetricType = iota
+	// ValidationAccuracy monitors R² for regression and subset accuracy for
+	// multi-label tasks.
+	ValidationAccuracy
+)
+
+type EarlyStoppingConf struct {
+	Monitor MetricType
+	// Patience is the number of epochs in a row without improvement that
+	// stops training, as in ReduceOnPlateau.
+	Patience    int
+	MinDelta    float64
+	RestoreBest bool
+}
+
+// EarlyStopping stops training at the Patience-th epoch in a row where the
+// monitored metric hasn't improved by MinDelta.
+type EarlyStopping struct {
+	BaseCallback
+	conf EarlyStoppingConf
+
+	best       float64
+	bestEpoch  int
+	wait       int
+	bestParams [][]float64
+}
+
+func NewEarlyStopping(conf EarlyStoppingConf) *EarlyStopping {
+	es := &EarlyStopping{conf: conf}
+	es.reset()
+	return es
+}
+
+func (es *EarlyStopping) reset() {
+	es.best = math.Inf(1)
+	if es.conf.Monitor == ValidationAccuracy {
+		es.best = math.Inf(-1)
+	}
+	es.bestEpoch = -1
+	es.wait = 0
+	es.bestParams = nil
+}
+
+func (es *EarlyStopping) improved(metric float64) bool {
+	if es.conf.Monitor == ValidationAccuracy {
+		return metric > es.best+es.conf.MinDelta
+	}
+	return metric < es.best-es.conf.MinDelta
+}
+
+// update records the metric for an epoch and reports whether training
+// should stop.
+func (es *EarlyStopping) update(nn *NeuralNetwork, epochIdx int, metric float64) bool {
+	if es.improved(metric) {
+		es.best = metric
+		es.bestEpoch = epochIdx
+		es.wait = 0
+		if es.conf.RestoreBest {
+			es.bestParams = nn.copyParams()
+		}
+		return false
+	}
+
+	es.wait++
+	return es.wait >= es.conf.Patience
+}
+
+func (es *EarlyStopping) OnTrainBegin(ctx *CallbackContext) {
+	if !ctx.Resumed {
+		es.reset()
+	}
+}
+
+func (es *EarlyStopping) OnEpochEnd(ctx *CallbackContext) {
+	metric := ctx.score()
+	if es.conf.Monitor == ValidationLoss {
+		metric = ctx.ValidationLoss()
+	}
+
+	if es.update(ctx.Trainer.NN, ctx.Epoch, metric) {
+		println("[INFO] Early stopping, best epoch :", es.bestEpoch)
+		ctx.StopTraining()
+	}
+}
+
+func (es *EarlyStopping) OnTrainEnd(ctx *CallbackContext) {
+	if es.conf.RestoreBest && es.bestParams != nil {
+		ctx.Trainer.NN.loadParams(es.bestParams)
+	}
+}
+
+// BestEpoch is the epoch with the best monitored metric, -1 before the first
+// evaluation.
+func (es *EarlyStopping) BestEpoch() int {
+	return es.bestEpoch
+}
+
+func (t *Trainer) earlyStopping() *EarlyStopping {
+	for _, cb := range t.activeCallbacks {
+		if es, ok := cb.(*EarlyStopping); ok {
+			return es
+		}
+	}
+	return nil
+}
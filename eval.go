@@ -4,11 +4,30 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"strings"
 )
 
 type History struct {
 	Loss []float64
 	Acc  []float64
+	Rate []float64
+
+	// Regression and MultiLabel replace Acc for those tasks.
+	Regression []RegressionEvaluation `json:",omitempty"`
+	MultiLabel []MultiLabelEvaluation `json:",omitempty"`
+}
+
+// scores lists the validation metric fed to schedulers for every epoch, as
+// returned by CallbackContext.score.
+func (h *History) scores() []float64 {
+	scores := append([]float64(nil), h.Acc...)
+	for _, eval := range h.Regression {
+		scores = append(scores, eval.R2)
+	}
+	for _, eval := range h.MultiLabel {
+		scores = append(scores, eval.SubsetAccuracy)
+	}
+	return scores
 }
 
 type EvaluationData struct {
@@ -17,13 +36,41 @@ type EvaluationData struct {
 	numCorrectPerClass []int
 	totalPerClass      []int
 	wronglyPredictedAs []int
+
+	// confusion counts samples by [true label][predicted label]
+	confusion [][]int
+	// rankCounts counts samples by the rank of their label in the outputs,
+	// 0 being the top prediction
+	rankCounts []int
 }
 
 func NewEvaluationData(numClasses int) *EvaluationData {
+	confusion := make([][]int, numClasses)
+	for i := range confusion {
+		confusion[i] = make([]int, numClasses)
+	}
+
 	return &EvaluationData{
 		numCorrectPerClass: make([]int, numClasses),
 		totalPerClass:      make([]int, numClasses),
 		wronglyPredictedAs: make([]int, numClasses),
+		confusion:          confusion,
+		rankCounts:         make([]int, numClasses),
+	}
+}
+
+func (ed *EvaluationData) add(label int, outputs []float64) {
+	predictedLabel := MaxValueIndex(outputs)
+	ed.rankCounts[labelRank(outputs, label)]++
+
+	ed.totalPerClass[label]++
+	ed.confusion[label][predictedLabel]++
+
+	if predictedLabel == label {
+		ed.numCorrectPerClass[label]++
+		ed.numCorrect++
+	} else {
+		ed.wronglyPredictedAs[predictedLabel]++
 	}
 }
 
@@ -35,6 +82,113 @@ func (ed *EvaluationData) GettAccuracy() float64 {
 	return (float64(ed.numCorrect) / float64(ed.total)) * 100
 }
 
+// TopKAccuracy is the percentage of samples whose label is among the k
+// highest outputs.
+func (ed *EvaluationData) TopKAccuracy(k int) float64 {
+	assert(k >= 0, "top k accuracy needs a non-negative k")
+	hits := 0
+	for _, count := range ed.rankCounts[:minInt(k, len(ed.rankCounts))] {
+		hits += count
+	}
+	return (float64(hits) / float64(ed.total)) * 100
+}
+
+// ClassMetrics holds the scores of one class, or their average over all
+// classes. Support is the number of samples of the class.
+type ClassMetrics struct {
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+	F1        float64 `json:"f1"`
+	Support   int     `json:"support"`
+}
+
+// ConfusionMatrix returns the sample counts indexed by [true label][predicted
+// label].
+func (ed *EvaluationData) ConfusionMatrix() [][]int {
+	confusion := make([][]int, len(ed.confusion))
+	for i, row := range ed.confusion {
+		confusion[i] = append([]int(nil), row...)
+	}
+	return confusion
+}
+
+// PerClassMetrics scores every class. A score is 0 when its denominator is,
+// like the precision of a class that was never predicted.
+func (ed *EvaluationData) PerClassMetrics() []ClassMetrics {
+	metrics := make([]ClassMetrics, len(ed.confusion))
+	for class := range metrics {
+		truePositives := ed.confusion[class][class]
+		predicted := 0
+		for label := range ed.confusion {
+			predicted += ed.confusion[label][class]
+		}
+
+		m := ClassMetrics{Support: ed.totalPerClass[class]}
+		m.Precision = safeDiv(float64(truePositives), float64(predicted))
+		m.Recall = safeDiv(float64(truePositives), float64(m.Support))
+		m.F1 = safeDiv(2*m.Precision*m.Recall, m.Precision+m.Recall)
+		metrics[class] = m
+	}
+	return metrics
+}
+
+// MacroAverage weighs every class the same.
+func (ed *EvaluationData) MacroAverage() ClassMetrics {
+	return averageMetrics(ed.PerClassMetrics(), false)
+}
+
+// WeightedAverage weighs every class by its support.
+func (ed *EvaluationData) WeightedAverage() ClassMetrics {
+	return averageMetrics(ed.PerClassMetrics(), true)
+}
+
+func averageMetrics(metrics []ClassMetrics, weighted bool) ClassMetrics {
+	avg := ClassMetrics{}
+	totalWeight := 0.0
+	for _, m := range metrics {
+		weight := 1.0
+		if weighted {
+			weight = float64(m.Support)
+		}
+		avg.Precision += weight * m.Precision
+		avg.Recall += weight * m.Recall
+		avg.F1 += weight * m.F1
+		avg.Support += m.Support
+		totalWeight += weight
+	}
+
+	avg.Precision = safeDiv(avg.Precision, totalWeight)
+	avg.Recall = safeDiv(avg.Recall, totalWeight)
+	avg.F1 = safeDiv(avg.F1, totalWeight)
+	return avg
+}
+
+// GetClassificationReport formats the per-class scores and their averages
+// as a table.
+func (ed *EvaluationData) GetClassificationReport() string {
+	var sb strings.Builder
+	row := func(name string, m ClassMetrics) {
+		fmt.Fprintf(&sb, "%12s %10.4f %10.4f %10.4f %10d\n", name, m.Precision, m.Recall, m.F1, m.Support)
+	}
+
+	fmt.Fprintf(&sb, "%12s %10s %10s %10s %10s\n", "", "precision", "recall", "f1-score", "support")
+	for class, m := range ed.PerClassMetrics() {
+		row(fmt.Sprintf("%d", class), m)
+	}
+	sb.WriteString("\n")
+	fmt.Fprintf(&sb, "%12s %10s %10s %10.4f %10d\n", "accuracy", "", "", ed.GettAccuracy()/100, ed.total)
+	row("macro avg", ed.MacroAverage())
+	row("weighted avg", ed.WeightedAverage())
+	return sb.String()
+}
+
+func safeDiv(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
+
 func (h *History) Save(path string) {
 	jsonData, err := json.Marshal(h)
 	if err != nil {
@@ -16,35 +16,35 @@ func LoadBatch(files []ImageFile, numLabels int) []DataPoint {
 func (t *Trainer) LoadIncData(training, validation []ImageFile) {
 	println("[INFO] Loading Inc Data")
 	t.incTrainingData, t.incValidationData = training, validation
-	t.incTrainingBatches = CreateMiniIncBatches(t.incTrainingData, t.Config.BatchSize)
 }
 
 func (t *Trainer) IncTrain(numLabels int) {
 	println("[INFO] Started Incremental Training")
-	currentRate := t.Config.Rate
-	totalBatches := len(t.incTrainingBatches)
-
-	for epochIdx := 0; epochIdx < t.Config.Epochs; epochIdx++ {
-		epochLoss := 0.0
-		for i := 0; i < totalBatches; i++ {
-			displayProgress(i, totalBatches)
-			batch := LoadBatch(t.incTrainingBatches[i].files, numLabels)
-			t.NN.Learn(batch, currentRate, t.Config.Regularization, t.Config.Momentum)
-			epochLoss += t.NN.calculateTotalLoss(batch)
-		}
-
-		evalutation := t.IncrementalEval(true, numLabels)
-		epochLoss = epochLoss / float64(totalBatches)
-		t.History.Loss = append(t.History.Loss, epochLoss)
-		t.History.Acc = append(t.History.Acc, evalutation.GettAccuracy())
-
-		if t.Config.OnEpochComplete != nil {
-			t.Config.OnEpochComplete(epochIdx, evalutation, epochLoss)
-		}
-
-		ShuffleBatches(t.incTrainingBatches)
-		currentRate = (1.0 / (1.0 + t.Config.RateDecay*float64(epochIdx))) * t.Config.Rate
+	labels := make([]int, len(t.incTrainingData))
+	for i, file := range t.incTrainingData {
+		labels[i] = file.Label
 	}
+	if t.Config.BalanceClasses {
+		t.NN.Config.ClassWeights = BalancedClassWeights(labels, numLabels)
+	}
+
+	t.fit(trainingRun{
+		labels: labels,
+		batch: func(indices []int) []DataPoint {
+			files := make([]ImageFile, len(indices))
+			for i, index := range indices {
+				files[i] = t.incTrainingData[index]
+			}
+			return LoadBatch(files, numLabels)
+		},
+		evaluate: func() *EvaluationData {
+			return t.IncrementalEval(true, numLabels)
+		},
+		validationLoss: func() float64 {
+			validation := LoadBatch(t.incValidationData, numLabels)
+			return t.NN.calculateTotalLoss(validation) / float64(len(validation))
+		},
+	})
 }
 
 func (t *Trainer) IncrementalEval(useEvalData bool, numLabels int) *EvaluationData {
@@ -65,18 +65,10 @@ func (t *Trainer) IncrementalEvaluate(data []ImageFile, numLabels int) *Evaluati
 	for _, dp := range data {
 		img := LoadSinglePNGImage(dp.FilePath, dp.Label, numLabels)
 		output := t.NN.CalculateOutputs(img.inputs)
-		predictedLabel := MaxValueIndex(output)
 
 		mu.Lock()
 
-		evalData.totalPerClass[dp.Label]++
-
-		if predictedLabel == dp.Label {
-			evalData.numCorrectPerClass[dp.Label]++
-			evalData.numCorrect++
-		} else {
-			evalData.wronglyPredictedAs[predictedLabel]++
-		}
+		evalData.add(dp.Label, output)
 
 		mu.Unlock()
 	}
@@ -0,0 +1,150 @@
+package neuralnetwork
+
+import (
+	"math"
+	"math/rand"
+)
+
+type InitializerType int
+
+const (
+	// Auto_I picks He initialization for ReLU-like activations and Xavier
+	// for the others.
+	Auto_I InitializerType = iota
+	XavierUniform_I
+	XavierNormal_I
+	HeUniform_I
+	HeNormal_I
+	LeCunUniform_I
+	LeCunNormal_I
+	Orthogonal_I
+	Constant_I
+	Custom_I
+)
+
+// InitConf picks how the weights and biases of a dense or convolutional
+// layer start out.
+type InitConf struct {
+	Type InitializerType `json:"type"`
+	// Gain scales the random weights, 1 by default.
+	Gain float64 `json:"gain,omitempty"`
+	// Value is every weight of Constant_I.
+	Value float64 `json:"value,omitempty"`
+	// Bias is every bias, whatever the weights' scheme.
+	Bias float64 `json:"bias,omitempty"`
+	// Fn fills the weights for Custom_I. It isn't saved, the weights are.
+	Fn func(weights []float64, fanIn, fanOut int, rng *rand.Rand) `json:"-"`
+}
+
+// defaultInitializer keeps the variance of the activations through layers of
+// act.
+func defaultInitializer(act ActivationType) InitializerType {
+	switch act {
+	case ReLU, LeakyReLU, PReLU, ELU, GELU, SiLU:
+		return HeNormal_I
+	default:
+		return XavierNormal_I
+	}
+}
+
+// resolved replaces Auto_I by the scheme it picks for act.
+func (conf InitConf) resolved(act ActivationType) InitConf {
+	if conf.Type == Auto_I {
+		conf.Type = defaultInitializer(act)
+	}
+	return conf
+}
+
+// initializeParams fills weights, laid out as one row of fanIn values per
+// output unit, and biases as conf says. conf must be resolved.
+func initializeParams(conf InitConf, weights, biases []float64, fanIn, fanOut int, rng *rand.Rand) {
+	gain := conf.Gain
+	if gain == 0 {
+		gain = 1
+	}
+
+	uniform := func(limit float64) {
+		for i := range weights {
+			weights[i] = (2*rng.Float64() - 1) * limit
+		}
+	}
+	normal := func(standardDeviation float64) {
+		for i := range weights {
+			weights[i] = randomIn(rng, 0, standardDeviation)
+		}
+	}
+
+	switch conf.Type {
+	case XavierUniform_I:
+		uniform(gain * math.Sqrt(6/float64(fanIn+fanOut)))
+	case XavierNormal_I:
+		normal(gain * math.Sqrt(2/float64(fanIn+fanOut)))
+	case HeUniform_I:
+		uniform(gain * math.Sqrt(6/float64(fanIn)))
+	case HeNormal_I:
+		normal(gain * math.Sqrt(2/float64(fanIn)))
+	case LeCunUniform_I:
+		uniform(gain * math.Sqrt(3/float64(fanIn)))
+	case LeCunNormal_I:
+		normal(gain / math.Sqrt(float64(fanIn)))
+	case Orthogonal_I:
+		orthogonal(weights, len(weights)/fanIn, fanIn, gain, rng)
+	case Constant_I:
+		for i := range weights {
+			weights[i] = conf.Value
+		}
+	case Custom_I:
+		assert(conf.Fn != nil, "custom initializer has no function")
+		conf.Fn(weights, fanIn, fanOut, rng)
+	default:
+		panic("Unhandled initializer type")
+	}
+
+	for i := range biases {
+		biases[i] = conf.Bias
+	}
+}
+
+// orthogonal fills the rows x cols weights with orthonormal rows, or
+// orthonormal columns when there are more rows than columns, scaled by gain.
+// The vectors are random normal ones made orthonormal by Gram-Schmidt.
+func orthogonal(weights []float64, rows, cols int, gain float64, rng *rand.Rand) {
+	numVectors, length := rows, cols
+	if rows > cols {
+		numVectors, length = cols, rows
+	}
+
+	vectors := make([][]float64, numVectors)
+	for i := range vectors {
+		v := make([]float64, length)
+		for norm := 0.0; norm < 1e-8; {
+			for k := range v {
+				v[k] = rng.NormFloat64()
+			}
+			// twice, to correct the rounding of the first pass
+			for pass := 0; pass < 2; pass++ {
+				for _, u := range vectors[:i] {
+					d := dot(u, v)
+					for k := range v {
+						v[k] -= d * u[k]
+					}
+				}
+			}
+			norm = math.Sqrt(dot(v, v))
+			for k := range v {
+				v[k] /= norm
+			}
+		}
+		vectors[i] = v
+	}
+
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			if rows > cols {
+				weights[r*cols+c] = gain * vectors[c][r]
+			} else {
+				weights[r*cols+c] = gain * vectors[r][c]
+			}
+		}
+	}
+}
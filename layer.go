@@ -1,157 +1,178 @@
 package neuralnetwork
 
 import (
+	"encoding/json"
+	"fmt"
 	"math"
 	"math/rand"
-	"sync"
 )
 
-type Layer struct {
-	NumNIn  int `json:"num_nodes_in"`
-	NumNOut int `json:"num_nodes_out"`
+type LayerType int
 
-	Weights []float64 `json:"weights"`
-	Biases  []float64 `json:"biases"`
-
-	lossGradientW, lossGradientB     []float64 `json:"-"`
-	weightVelocities, biasVelocities []float64 `json:"-"`
-	muW                              sync.Mutex
-	muB                              sync.Mutex
-
-	ActivationFn IActivation `json:"-"`
-}
-
-func NewLayer(numIn, numOut int, rng *rand.Rand) *Layer {
-	l := &Layer{
-		NumNIn: numIn, NumNOut: numOut,
-	}
-	l.Weights = make([]float64, numIn*numOut)
-	l.Biases = make([]float64, numOut)
-
-	l.lossGradientW = make([]float64, len(l.Weights))
-	l.lossGradientB = make([]float64, numOut)
-
-	l.weightVelocities = make([]float64, len(l.Weights))
-	l.biasVelocities = make([]float64, numOut)
+const (
+	Dense_L LayerType = iota
+	Dropout_L
+	BatchNorm_L
+	Conv2D_L
+	MaxPool2D_L
+	AvgPool2D_L
+	Flatten_L
+)
 
-	l.InitializeRandomWeights(rng)
-	return l
+// LayerI is a stackable network layer. Forward and Backward work on a whole
+// batch, one matrix row per sample, and share the learn data created for them.
+type LayerI interface {
+	Type() LayerType
+	NumIn() int
+	NumOut() int
+
+	// CalculateOutputs runs the layer in inference mode on a single sample.
+	CalculateOutputs(inputs []float64) []float64
+	// Forward runs the layer in training mode and returns the outputs.
+	Forward(inputs *Matrix, learnData *LayerLearnData) *Matrix
+	// Backward takes the loss gradients wrt the outputs, accumulates the
+	// parameter gradients and returns the loss gradients wrt the inputs
+	// (nil when the learn data doesn't need them).
+	Backward(outputGradients *Matrix, learnData *LayerLearnData) *Matrix
+
+	// Parameters lists the layer's learned values. Entries without
+	// gradients, like running statistics, aren't touched by the optimizer.
+	Parameters() []*Parameter
+	// InitLearningState allocates the gradient and optimizer buffers, which
+	// are not part of the saved network.
+	InitLearningState()
 }
 
-func (l *Layer) SetActivation(act ActivationType) {
-	l.ActivationFn = GetActivationFromType(act)
+type Parameter struct {
+	Values    []float64
+	Gradients []float64
+	State     *OptimizerState
+	// Decay is set when regularization applies to the values.
+	Decay bool
 }
 
-func (l *Layer) InitializeRandomWeights(rng *rand.Rand) {
-	for i := range l.Weights {
-		l.Weights[i] = randomIn(rng, 0, 1) / math.Sqrt(float64(l.NumNIn))
+// ApplyGradient averages the accumulated gradients over the batch, hands them
+// to the optimizer and resets them for the next batch.
+func (p *Parameter) ApplyGradient(optimizer IOptimizer, learnRate, regularization float64, batchSize int) {
+	if p.Gradients == nil {
+		return
 	}
-}
 
-func (l *Layer) CalculateLearningOutputs(inputs []float64, learnData *LayerLearnData) []float64 {
-	learnData.inputs = inputs
+	scale := 1 / float64(batchSize)
+	for i := range p.Gradients {
+		p.Gradients[i] *= scale
+	}
 
-	for nodeOut := 0; nodeOut < l.NumNOut; nodeOut++ {
-		weightedInput := l.Biases[nodeOut]
-		for nodeIn := 0; nodeIn < l.NumNIn; nodeIn++ {
-			weightedInput += inputs[nodeIn] * l.GetWeight(nodeIn, nodeOut)
-		}
-		learnData.weightedInputs[nodeOut] = weightedInput
+	if !p.Decay {
+		regularization = 0
 	}
+	optimizer.Update(p.Values, p.Gradients, p.State, learnRate, regularization*scale, p.Decay)
 
-	for i := range learnData.activations {
-		learnData.activations[i] = l.ActivationFn.Activate(learnData.weightedInputs, i)
+	for i := range p.Gradients {
+		p.Gradients[i] = 0
 	}
+}
 
-	return learnData.activations
+// LayerConf describes one layer when building a network from NNConf.Layers.
+// Size is the number of dense nodes, Rate the dropout rate. Stride defaults
+// to 1 for convolutions and to PoolSize for pooling. ActivationAlpha is the
+// alpha of LeakyReLU, ELU and PReLU, 0 picking their default. Init sets up
+// the weights of dense and convolutional layers, which save it.
+type LayerConf struct {
+	Type            LayerType
+	Size            int
+	Activation      ActivationType
+	ActivationAlpha float64
+	Rate            float64
+	Init            InitConf
+
+	Filters    int
+	KernelSize int
+	Stride     int
+	Padding    int
+	PoolSize   int
 }
 
-func (l *Layer) CalculateOutputLayerNodeValues(layerLearnData *LayerLearnData, expectedOutputs []float64, loss ILoss) (lossDerivative float64) {
-	for i := 0; i < len(layerLearnData.nodeValues); i++ {
-		lossDerivative = loss.LossDerivative(layerLearnData.activations[i], expectedOutputs[i])
-		activationDerivative := l.ActivationFn.Derivative(layerLearnData.weightedInputs, i)
-		layerLearnData.nodeValues[i] = lossDerivative * activationDerivative
+func newLayerFromConf(conf LayerConf, inShape Shape, rng *rand.Rand) (LayerI, Shape) {
+	switch conf.Type {
+	case Dense_L:
+		l := newDenseLayer(inShape.Size(), conf.Size)
+		l.ActivationAlpha = conf.ActivationAlpha
+		l.SetActivation(conf.Activation)
+		l.InitializeWeights(conf.Init, rng)
+		return l, FlatShape(conf.Size)
+	case Dropout_L:
+		return NewDropoutLayer(inShape.Size(), conf.Rate), inShape
+	case BatchNorm_L:
+		return NewBatchNormLayer(inShape.Size()), inShape
+	case Conv2D_L:
+		l := newConv2DLayer(inShape, conf.Filters, conf.KernelSize, conf.Stride, conf.Padding)
+		l.ActivationAlpha = conf.ActivationAlpha
+		l.SetActivation(conf.Activation)
+		l.InitializeWeights(conf.Init, rng)
+		return l, l.OutShape
+	case MaxPool2D_L:
+		l := NewMaxPool2DLayer(inShape, conf.PoolSize, conf.Stride)
+		return l, l.OutShape
+	case AvgPool2D_L:
+		l := NewAvgPool2DLayer(inShape, conf.PoolSize, conf.Stride)
+		return l, l.OutShape
+	case Flatten_L:
+		return NewFlattenLayer(inShape), FlatShape(inShape.Size())
+	default:
+		panic("Unhandled layer type")
 	}
-	return
 }
 
-func (l *Layer) UpdateGradients(layerLearnData *LayerLearnData) {
-
-	l.muW.Lock()
-	for nodeOut := 0; nodeOut < l.NumNOut; nodeOut++ {
-		nodeValue := layerLearnData.nodeValues[nodeOut]
-		for nodeIn := 0; nodeIn < l.NumNIn; nodeIn++ {
-			derivativeLossWrtWeight := layerLearnData.inputs[nodeIn] * nodeValue
-			l.lossGradientW[l.GetFlatWeightIndex(nodeIn, nodeOut)] += derivativeLossWrtWeight
-		}
+func marshalLayer(layer LayerI) (json.RawMessage, error) {
+	data, err := json.Marshal(layer)
+	if err != nil {
+		return nil, err
 	}
-	l.muW.Unlock()
 
-	l.muB.Lock()
-	for nodeOut := 0; nodeOut < l.NumNOut; nodeOut++ {
-		derivativeLossWrtBias := 1 * layerLearnData.nodeValues[nodeOut]
-		l.lossGradientB[nodeOut] += derivativeLossWrtBias
+	typeField := fmt.Sprintf(`{"type":%d`, layer.Type())
+	if string(data) == "{}" {
+		return json.RawMessage(typeField + "}"), nil
 	}
-	l.muB.Unlock()
+	return json.RawMessage(typeField + "," + string(data[1:])), nil
 }
 
-func (l *Layer) CalculateHiddenLayerNodeValues(layerLearnData *LayerLearnData, oldLayer *Layer, oldNodeValues []float64) {
-	for newNodeIndex := 0; newNodeIndex < l.NumNOut; newNodeIndex++ {
-		newNodeVal := 0.0
-		for oldNodeIndex := 0; oldNodeIndex < len(oldNodeValues); oldNodeIndex++ {
-			weightedInputDerivative := oldLayer.GetWeight(newNodeIndex, oldNodeIndex)
-			newNodeVal += weightedInputDerivative * oldNodeValues[oldNodeIndex]
-		}
-		newNodeVal *= l.ActivationFn.Derivative(layerLearnData.weightedInputs, newNodeIndex)
-		layerLearnData.nodeValues[newNodeIndex] = newNodeVal
+// unmarshalLayer decodes a layer saved by marshalLayer. Layers saved before
+// the type was recorded are dense, legacy is set for them.
+func unmarshalLayer(data json.RawMessage) (layer LayerI, legacy bool, err error) {
+	var header struct {
+		Type *LayerType `json:"type"`
 	}
-}
-
-func (l *Layer) ApplyGradient(learnRate, regularization, momentum float64) {
-	weightDecay := (1 - regularization*learnRate)
-	for i := 0; i < len(l.Weights); i++ {
-		weight := l.Weights[i]
-		velocity := l.weightVelocities[i]*momentum - l.lossGradientW[i]*learnRate
-
-		l.weightVelocities[i] = velocity
-		l.Weights[i] = weight*weightDecay + velocity
-		l.lossGradientW[i] = 0
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, false, err
 	}
 
-	for i := 0; i < len(l.Biases); i++ {
-		velocity := l.biasVelocities[i]*momentum - l.lossGradientB[i]*learnRate
-		l.biasVelocities[i] = velocity
-		l.Biases[i] += velocity
-		l.lossGradientB[i] = 0
+	layerType := Dense_L
+	if header.Type != nil {
+		layerType = *header.Type
 	}
-}
-
-func (l *Layer) CalculateOutputs(inputs []float64) []float64 {
-	weightedInputs := make([]float64, l.NumNOut)
 
-	for nodeOut := 0; nodeOut < l.NumNOut; nodeOut++ {
-		weightedInput := l.Biases[nodeOut]
-		for nodeIn := 0; nodeIn < l.NumNIn; nodeIn++ {
-			weightedInput += inputs[nodeIn] * l.GetWeight(nodeIn, nodeOut)
-		}
-		weightedInputs[nodeOut] = weightedInput
+	switch layerType {
+	case Dense_L:
+		layer = &DenseLayer{}
+	case Dropout_L:
+		layer = &DropoutLayer{}
+	case BatchNorm_L:
+		layer = &BatchNormLayer{}
+	case Conv2D_L:
+		layer = &Conv2DLayer{}
+	case MaxPool2D_L, AvgPool2D_L:
+		layer = &Pool2DLayer{layerType: layerType}
+	case Flatten_L:
+		layer = &FlattenLayer{}
+	default:
+		return nil, false, fmt.Errorf("unknown layer type %d", layerType)
 	}
 
-	activations := make([]float64, l.NumNOut)
-	for outputNode := 0; outputNode < l.NumNOut; outputNode++ {
-		activations[outputNode] = l.ActivationFn.Activate(weightedInputs, outputNode)
+	if err := json.Unmarshal(data, layer); err != nil {
+		return nil, false, err
 	}
-
-	return activations
-}
-
-func (l *Layer) GetFlatWeightIndex(inIndex, outIndex int) int {
-	return outIndex*l.NumNIn + inIndex
-}
-
-func (l *Layer) GetWeight(nodeIn, nodeOut int) float64 {
-	index := l.GetFlatWeightIndex(nodeIn, nodeOut)
-	return l.Weights[index]
+	return layer, header.Type == nil, nil
 }
 
 func randomIn(rng *rand.Rand, mean, standardDeviation float64) float64 {
@@ -1,30 +1,139 @@
 package neuralnetwork
 
+import "math/rand"
+
+// LayerLearnData is the per-batch scratch a layer keeps between Forward and
+// Backward, one matrix row per sample.
 type LayerLearnData struct {
-	inputs         []float64
-	weightedInputs []float64
-	activations    []float64
-	nodeValues     []float64
+	inputs         *Matrix
+	outputs        *Matrix
+	inputGradients *Matrix
+
+	// cache holds the per-sample values a layer type needs for backprop,
+	// like weighted inputs or dropout masks
+	cache *Matrix
+	rng   *rand.Rand
+
+	// logitGradients is set on the output layer when a fused loss already
+	// gives the gradients wrt its weighted inputs
+	logitGradients bool
+
+	// transposed operands and per-chunk gradient buffers, reused between
+	// batches
+	scratch       []*Matrix
+	workerBuffers [][]float64
+}
+
+// NewLayerLearnData leaves the input gradients out when they aren't needed,
+// which is the case for the first layer.
+func NewLayerLearnData(layer LayerI, batchSize int, needInputGradients bool, rng *rand.Rand) *LayerLearnData {
+	ld := &LayerLearnData{
+		outputs: NewMatrix(batchSize, layer.NumOut()),
+		rng:     rng,
+	}
+	if needInputGradients {
+		ld.inputGradients = NewMatrix(batchSize, layer.NumIn())
+	}
+	return ld
+}
+
+func (ld *LayerLearnData) allocCache(size int) {
+	if ld.cache == nil {
+		ld.cache = NewMatrix(ld.outputs.Rows, size)
+		return
+	}
+	ld.cache.reshape(ld.outputs.Rows, size)
+}
+
+func (ld *LayerLearnData) resize(batchSize int) {
+	ld.outputs.reshape(batchSize, ld.outputs.Cols)
+	if ld.inputGradients != nil {
+		ld.inputGradients.reshape(batchSize, ld.inputGradients.Cols)
+	}
 }
 
-func NewLayerLearnData(layer *Layer) *LayerLearnData {
-	return &LayerLearnData{
-		weightedInputs: make([]float64, layer.NumNOut),
-		activations:    make([]float64, layer.NumNOut),
-		nodeValues:     make([]float64, layer.NumNOut),
+// transpose writes m transposed into the i-th scratch matrix.
+func (ld *LayerLearnData) transpose(i int, m *Matrix) *Matrix {
+	for len(ld.scratch) <= i {
+		ld.scratch = append(ld.scratch, nil)
 	}
+	ld.scratch[i] = m.transposeInto(ld.scratch[i])
+	return ld.scratch[i]
 }
 
+// accumulateChunks is how many parts accumulate splits its samples in. It
+// doesn't depend on the number of CPUs, so neither does the order the
+// gradients are summed in.
+const accumulateChunks = 16
+
+// accumulate gives every chunk of [0, n) its own zeroed buffer holding all
+// the gradients back to back, then adds the buffers into them in chunk
+// order, so no locking is needed while accumulating.
+func (ld *LayerLearnData) accumulate(n int, fn func(buffer []float64, start, end int), gradients ...[]float64) {
+	size := 0
+	for _, g := range gradients {
+		size += len(g)
+	}
+
+	chunks := minInt(accumulateChunks, n)
+	if chunks == 0 {
+		return
+	}
+	chunkSize := (n + chunks - 1) / chunks
+	chunks = (n + chunkSize - 1) / chunkSize
+	for len(ld.workerBuffers) < chunks {
+		ld.workerBuffers = append(ld.workerBuffers, make([]float64, size))
+	}
+
+	parallelFor(chunks, func(c int) {
+		buffer := ld.workerBuffers[c]
+		for i := range buffer {
+			buffer[i] = 0
+		}
+		fn(buffer, c*chunkSize, minInt((c+1)*chunkSize, n))
+	})
+
+	for _, buffer := range ld.workerBuffers[:chunks] {
+		for _, g := range gradients {
+			for i := range g {
+				g[i] += buffer[i]
+			}
+			buffer = buffer[len(g):]
+		}
+	}
+}
+
+// NetworkLearnData holds the scratch of one network. Its buffers keep the
+// capacity of the largest batch seen, so batches of other sizes, like the
+// short last one, reuse them instead of reallocating.
 type NetworkLearnData struct {
+	inputs          *Matrix
+	outputGradients *Matrix
+	// targets holds the label smoothed expected outputs
+	targets   *Matrix
 	layerData []*LayerLearnData
 }
 
-func NewNetworkLearnData(layers []*Layer) *NetworkLearnData {
+// NewNetworkLearnData gives rng to the layers drawing random numbers while
+// training, like dropout.
+func NewNetworkLearnData(layers []LayerI, batchSize int, rng *rand.Rand) *NetworkLearnData {
 	layerData := make([]*LayerLearnData, len(layers))
 	for i, layer := range layers {
-		layerData[i] = NewLayerLearnData(layer)
+		layerData[i] = NewLayerLearnData(layer, batchSize, i > 0, rng)
 	}
 	return &NetworkLearnData{
-		layerData: layerData,
+		inputs:          NewMatrix(batchSize, layers[0].NumIn()),
+		outputGradients: NewMatrix(batchSize, layers[len(layers)-1].NumOut()),
+		targets:         NewMatrix(batchSize, layers[len(layers)-1].NumOut()),
+		layerData:       layerData,
+	}
+}
+
+func (ld *NetworkLearnData) resize(batchSize int) {
+	ld.inputs.reshape(batchSize, ld.inputs.Cols)
+	ld.outputGradients.reshape(batchSize, ld.outputGradients.Cols)
+	ld.targets.reshape(batchSize, ld.targets.Cols)
+	for _, layerData := range ld.layerData {
+		layerData.resize(batchSize)
 	}
 }
@@ -9,16 +9,53 @@ const (
 	CrossEntropy_T
 
 	BinaryCrossEntropy_T
+	Huber_T
+	MeanAbsoluteError_T
+	Hinge_T
+	KLDivergence_T
+	Focal_T
 )
 
+// SmoothL1_T is the Huber loss, which is smooth L1 with the default delta.
+const SmoothL1_T = Huber_T
+
 type ILoss interface {
 	LossFunction(predictedOutputs []float64, expectedOutputs []float64) float64
-	LossDerivative(predictedOutput, expectedOutput float64) float64
+	// LossGradients writes the gradients of LossFunction wrt every predicted
+	// output.
+	LossGradients(predictedOutputs, expectedOutputs, gradients []float64)
 }
 
 type Loss struct{}
 
+// LossConf holds the parameters of the losses using them, unset values pick
+// the defaults.
+type LossConf struct {
+	// Delta is where Huber switches from quadratic to linear, 1 when 0.
+	Delta float64 `json:"delta,omitempty"`
+	// Gamma and Alpha are the focusing and class balancing parameters of the
+	// focal loss, 2 and 0.25 when nil. Gamma 0 is alpha-balanced cross
+	// entropy.
+	Gamma *float64 `json:"gamma,omitempty"`
+	Alpha *float64 `json:"alpha,omitempty"`
+}
+
 func GetLossFromType(lossType LossType) ILoss {
+	return newLoss(lossType, LossConf{})
+}
+
+func newLoss(lossType LossType, conf LossConf) ILoss {
+	if conf.Delta == 0 {
+		conf.Delta = 1
+	}
+	gamma, alpha := 2.0, 0.25
+	if conf.Gamma != nil {
+		gamma = *conf.Gamma
+	}
+	if conf.Alpha != nil {
+		alpha = *conf.Alpha
+	}
+
 	switch lossType {
 	case MeanSquareError_T:
 		return MeanSquaredError{}
@@ -26,40 +63,50 @@ func GetLossFromType(lossType LossType) ILoss {
 		return CrossEntropy{}
 	case BinaryCrossEntropy_T:
 		return BinaryCrossEntropy{}
+	case Huber_T:
+		return Huber{Delta: conf.Delta}
+	case MeanAbsoluteError_T:
+		return MeanAbsoluteError{}
+	case Hinge_T:
+		return Hinge{}
+	case KLDivergence_T:
+		return KLDivergence{}
+	case Focal_T:
+		return Focal{Gamma: gamma, Alpha: alpha}
 	default:
 		panic("Unhandled loss type")
 	}
 }
 
+// gradientsEach applies the derivative of a loss summed over its outputs to
+// every output.
+func gradientsEach(predictedOutputs, expectedOutputs, gradients []float64, derivative func(x, y float64) float64) {
+	for i, x := range predictedOutputs {
+		gradients[i] = derivative(x, expectedOutputs[i])
+	}
+}
+
 type CrossEntropy struct{}
 
+// LossFunction clamps the outputs away from 0 and 1 so saturated outputs
+// give a large loss rather than an infinite one.
 func (c CrossEntropy) LossFunction(predictedOutputs, expectedOutputs []float64) float64 {
 	loss := 0.0
 	for i := 0; i < len(predictedOutputs); i++ {
-		x := predictedOutputs[i]
+		x := math.Min(math.Max(predictedOutputs[i], logEpsilon), 1-logEpsilon)
 		y := expectedOutputs[i]
-		v := 0.0
-
-		if y == 1 {
-			v = -math.Log(x)
-
-		} else if y == 0 {
-			v = -math.Log(1 - x)
-		}
-
-		if !math.IsNaN(v) {
-			loss += v
-		}
+		loss -= y*math.Log(x) + (1-y)*math.Log(1-x)
 	}
 	return loss
 }
 
+func (c CrossEntropy) LossGradients(predictedOutputs, expectedOutputs, gradients []float64) {
+	gradientsEach(predictedOutputs, expectedOutputs, gradients, c.LossDerivative)
+}
+
 func (c CrossEntropy) LossDerivative(predictedOutput, expectedOutput float64) float64 {
-	x := predictedOutput
+	x := math.Min(math.Max(predictedOutput, logEpsilon), 1-logEpsilon)
 	y := expectedOutput
-	if x == 0 || x == 1 {
-		return 0
-	}
 	return (-x + y) / (x * (x - 1))
 }
 
@@ -74,36 +121,293 @@ func (mse MeanSquaredError) LossFunction(predictedOutputs, expectedOutputs []flo
 	return 0.5 * loss
 }
 
+func (mse MeanSquaredError) LossGradients(predictedOutputs, expectedOutputs, gradients []float64) {
+	gradientsEach(predictedOutputs, expectedOutputs, gradients, mse.LossDerivative)
+}
+
 func (mse MeanSquaredError) LossDerivative(predictedOutput, expectedOutput float64) float64 {
 	return predictedOutput - expectedOutput
 }
 
 type BinaryCrossEntropy struct{}
 
+// LossFunction clamps the outputs like CrossEntropy.
 func (bce BinaryCrossEntropy) LossFunction(predictedOutputs, expectedOutputs []float64) float64 {
 	loss := 0.0
 	for i := 0; i < len(predictedOutputs); i++ {
-		x := predictedOutputs[i]
+		x := math.Min(math.Max(predictedOutputs[i], logEpsilon), 1-logEpsilon)
 		y := expectedOutputs[i]
+		loss -= y*math.Log(x) + (1-y)*math.Log(1-x)
+	}
+	return loss
+}
+
+func (bce BinaryCrossEntropy) LossGradients(predictedOutputs, expectedOutputs, gradients []float64) {
+	gradientsEach(predictedOutputs, expectedOutputs, gradients, bce.LossDerivative)
+}
 
-		v := -y*math.Log(x) - (1-y)*math.Log(1-x)
+func (bce BinaryCrossEntropy) LossDerivative(predictedOutput, expectedOutput float64) float64 {
+	x := math.Min(math.Max(predictedOutput, logEpsilon), 1-logEpsilon)
+	y := expectedOutput
+	return -y/x + (1-y)/(1-x)
+}
 
-		if !math.IsNaN(v) {
-			loss += v
+// Huber is quadratic for errors within Delta and linear beyond, so outliers
+// weigh less than with MSE.
+type Huber struct {
+	Delta float64
+}
+
+func (h Huber) LossFunction(predictedOutputs, expectedOutputs []float64) float64 {
+	loss := 0.0
+	for i, x := range predictedOutputs {
+		err := math.Abs(x - expectedOutputs[i])
+		if err <= h.Delta {
+			loss += 0.5 * err * err
+		} else {
+			loss += h.Delta * (err - 0.5*h.Delta)
 		}
 	}
 	return loss
 }
 
-func (bce BinaryCrossEntropy) LossDerivative(predictedOutput, expectedOutput float64) float64 {
-	x := predictedOutput
+func (h Huber) LossDerivative(predictedOutput, expectedOutput float64) float64 {
+	return math.Max(-h.Delta, math.Min(h.Delta, predictedOutput-expectedOutput))
+}
+
+func (h Huber) LossGradients(predictedOutputs, expectedOutputs, gradients []float64) {
+	gradientsEach(predictedOutputs, expectedOutputs, gradients, h.LossDerivative)
+}
+
+type MeanAbsoluteError struct{}
+
+func (mae MeanAbsoluteError) LossFunction(predictedOutputs, expectedOutputs []float64) float64 {
+	loss := 0.0
+	for i, x := range predictedOutputs {
+		loss += math.Abs(x - expectedOutputs[i])
+	}
+	return loss
+}
+
+// LossDerivative is the sign of the error, 0 when there is none.
+func (mae MeanAbsoluteError) LossDerivative(predictedOutput, expectedOutput float64) float64 {
+	err := predictedOutput - expectedOutput
+	if err > 0 {
+		return 1
+	} else if err < 0 {
+		return -1
+	}
+	return 0
+}
+
+func (mae MeanAbsoluteError) LossGradients(predictedOutputs, expectedOutputs, gradients []float64) {
+	gradientsEach(predictedOutputs, expectedOutputs, gradients, mae.LossDerivative)
+}
+
+// Hinge is the multi-class hinge loss Σ_j max(0, 1 + s_j - s_y) over the
+// classes j other than the expected one y, for identity outputs.
+type Hinge struct{}
+
+func (h Hinge) LossFunction(predictedOutputs, expectedOutputs []float64) float64 {
+	label := MaxValueIndex(expectedOutputs)
+	loss := 0.0
+	for j, score := range predictedOutputs {
+		if j != label {
+			loss += math.Max(0, 1+score-predictedOutputs[label])
+		}
+	}
+	return loss
+}
+
+// LossGradients gives 1 to every class within the margin of the expected one,
+// which gets minus their count.
+func (h Hinge) LossGradients(predictedOutputs, expectedOutputs, gradients []float64) {
+	label := MaxValueIndex(expectedOutputs)
+	gradients[label] = 0
+	for j, score := range predictedOutputs {
+		if j == label {
+			continue
+		}
+		gradients[j] = 0
+		if 1+score-predictedOutputs[label] > 0 {
+			gradients[j] = 1
+			gradients[label]--
+		}
+	}
+}
+
+// KLDivergence is Σ y_i log(y_i / p_i), the divergence of the predicted
+// distribution from the expected one.
+type KLDivergence struct{}
+
+func (kl KLDivergence) LossFunction(predictedOutputs, expectedOutputs []float64) float64 {
+	loss := 0.0
+	for i, y := range expectedOutputs {
+		if y > 0 {
+			loss += y * (math.Log(y) - math.Log(math.Max(predictedOutputs[i], logEpsilon)))
+		}
+	}
+	return loss
+}
+
+func (kl KLDivergence) LossDerivative(predictedOutput, expectedOutput float64) float64 {
+	return -expectedOutput / math.Max(predictedOutput, logEpsilon)
+}
+
+func (kl KLDivergence) LossGradients(predictedOutputs, expectedOutputs, gradients []float64) {
+	gradientsEach(predictedOutputs, expectedOutputs, gradients, kl.LossDerivative)
+}
+
+// Focal is the binary focal loss of every output,
+// -α y (1-p)^γ log p - (1-α) (1-y) p^γ log(1-p). It scales down the loss of
+// outputs that are already right, so training focuses on the hard, often
+// rare, samples. Alpha weighs the positive outputs.
+type Focal struct {
+	Gamma, Alpha float64
+}
+
+func (f Focal) LossFunction(predictedOutputs, expectedOutputs []float64) float64 {
+	loss := 0.0
+	for i, y := range expectedOutputs {
+		p := math.Min(math.Max(predictedOutputs[i], logEpsilon), 1-logEpsilon)
+		loss -= f.Alpha*y*math.Pow(1-p, f.Gamma)*math.Log(p) +
+			(1-f.Alpha)*(1-y)*math.Pow(p, f.Gamma)*math.Log(1-p)
+	}
+	return loss
+}
+
+func (f Focal) LossDerivative(predictedOutput, expectedOutput float64) float64 {
+	p := math.Min(math.Max(predictedOutput, logEpsilon), 1-logEpsilon)
 	y := expectedOutput
+	positive := f.Gamma*math.Pow(1-p, f.Gamma-1)*math.Log(p) - math.Pow(1-p, f.Gamma)/p
+	negative := math.Pow(p, f.Gamma)/(1-p) - f.Gamma*math.Pow(p, f.Gamma-1)*math.Log(1-p)
+	return f.Alpha*y*positive + (1-f.Alpha)*(1-y)*negative
+}
+
+func (f Focal) LossGradients(predictedOutputs, expectedOutputs, gradients []float64) {
+	gradientsEach(predictedOutputs, expectedOutputs, gradients, f.LossDerivative)
+}
+
+// IFusedLoss is a loss fused with the output activation it pairs with. Its
+// gradients wrt the weighted inputs of the output layer, the logits, reduce
+// to predicted - expected, and its loss is computed from the logits, so
+// neither vanishes nor blows up when the outputs saturate.
+type IFusedLoss interface {
+	ILoss
+	// LogitLoss is the loss given the logits of the output layer.
+	LogitLoss(logits, expectedOutputs []float64) float64
+	// LogitGradients writes the loss gradients wrt the logits, given the
+	// activations of the output layer.
+	LogitGradients(predictedOutputs, expectedOutputs, gradients []float64)
+}
+
+// getFusedLoss returns the loss of lossType fused with the output
+// activation, or nil when they don't fuse. Cross entropy over sigmoid outputs
+// is the binary cross entropy of each of them.
+func getFusedLoss(lossType LossType, outActivation ActivationType) IFusedLoss {
+	switch {
+	case lossType == CrossEntropy_T && outActivation == Softmax:
+		return SoftmaxCrossEntropy{}
+	case (lossType == CrossEntropy_T || lossType == BinaryCrossEntropy_T) && outActivation == Sigmoid:
+		return SigmoidBinaryCrossEntropy{}
+	default:
+		return nil
+	}
+}
+
+// logEpsilon keeps the logs finite when the fused losses are given saturated
+// probabilities rather than logits.
+const logEpsilon = 1e-15
+
+// logSumExp computes log Σ e^x_i, shifted by the largest x so the
+// exponentials can't overflow.
+func logSumExp(xs []float64) float64 {
+	maxX := math.Inf(-1)
+	for _, x := range xs {
+		maxX = math.Max(maxX, x)
+	}
+	sum := 0.0
+	for _, x := range xs {
+		sum += math.Exp(x - maxX)
+	}
+	return maxX + math.Log(sum)
+}
+
+// SoftmaxCrossEntropy is -Σ y_i log p_i over softmax outputs.
+type SoftmaxCrossEntropy struct{}
+
+func (c SoftmaxCrossEntropy) LossFunction(predictedOutputs, expectedOutputs []float64) float64 {
+	loss := 0.0
+	for i, y := range expectedOutputs {
+		loss -= y * math.Log(math.Max(predictedOutputs[i], logEpsilon))
+	}
+	return loss
+}
+
+func (c SoftmaxCrossEntropy) LossGradients(predictedOutputs, expectedOutputs, gradients []float64) {
+	gradientsEach(predictedOutputs, expectedOutputs, gradients, c.LossDerivative)
+}
+
+func (c SoftmaxCrossEntropy) LossDerivative(predictedOutput, expectedOutput float64) float64 {
+	return -expectedOutput / math.Max(predictedOutput, logEpsilon)
+}
+
+// LogitLoss uses log p_i = z_i - log Σ_j e^z_j.
+func (c SoftmaxCrossEntropy) LogitLoss(logits, expectedOutputs []float64) float64 {
+	logSum := logSumExp(logits)
+	loss := 0.0
+	for i, y := range expectedOutputs {
+		loss += y * (logSum - logits[i])
+	}
+	return loss
+}
+
+// LogitGradients is p_i Σ_j y_j - y_i, which is p_i - y_i when the expected
+// outputs sum to 1.
+func (c SoftmaxCrossEntropy) LogitGradients(predictedOutputs, expectedOutputs, gradients []float64) {
+	sum := 0.0
+	for _, y := range expectedOutputs {
+		sum += y
+	}
+	for i, p := range predictedOutputs {
+		gradients[i] = p*sum - expectedOutputs[i]
+	}
+}
+
+// SigmoidBinaryCrossEntropy is the binary cross entropy of every sigmoid
+// output.
+type SigmoidBinaryCrossEntropy struct{}
+
+func (bce SigmoidBinaryCrossEntropy) LossFunction(predictedOutputs, expectedOutputs []float64) float64 {
+	loss := 0.0
+	for i, y := range expectedOutputs {
+		x := predictedOutputs[i]
+		loss -= y*math.Log(math.Max(x, logEpsilon)) + (1-y)*math.Log(math.Max(1-x, logEpsilon))
+	}
+	return loss
+}
 
-	if x == 0 {
-		return 1e10
-	} else if x == 1 {
-		return -1e10
+func (bce SigmoidBinaryCrossEntropy) LossGradients(predictedOutputs, expectedOutputs, gradients []float64) {
+	gradientsEach(predictedOutputs, expectedOutputs, gradients, bce.LossDerivative)
+}
+
+func (bce SigmoidBinaryCrossEntropy) LossDerivative(predictedOutput, expectedOutput float64) float64 {
+	x := math.Min(math.Max(predictedOutput, logEpsilon), 1-logEpsilon)
+	return (x - expectedOutput) / (x * (1 - x))
+}
+
+// LogitLoss is Σ max(z, 0) - z y + log(1 + e^-|z|), the softplus form of
+// -y log σ(z) - (1 - y) log(1 - σ(z)).
+func (bce SigmoidBinaryCrossEntropy) LogitLoss(logits, expectedOutputs []float64) float64 {
+	loss := 0.0
+	for i, z := range logits {
+		loss += math.Max(z, 0) - z*expectedOutputs[i] + math.Log1p(math.Exp(-math.Abs(z)))
 	}
+	return loss
+}
 
-	return (-y/x + (1-y)/(1-x))
+func (bce SigmoidBinaryCrossEntropy) LogitGradients(predictedOutputs, expectedOutputs, gradients []float64) {
+	for i, p := range predictedOutputs {
+		gradients[i] = p - expectedOutputs[i]
+	}
 }
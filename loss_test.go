@@ -0,0 +1,134 @@
+package neuralnetwork
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+var allLosses = []LossType{
+	MeanSquareError_T, CrossEntropy_T, BinaryCrossEntropy_T,
+	Huber_T, MeanAbsoluteError_T, Hinge_T, KLDivergence_T, Focal_T,
+}
+
+// lossSample draws probabilities away from 0 and 1 and a smoothed one-hot
+// target, so no loss sits on a kink.
+func lossSample(rng *rand.Rand, n int) (predicted, expected []float64) {
+	predicted = make([]float64, n)
+	expected = make([]float64, n)
+	label := rng.Intn(n)
+	for i := range predicted {
+		predicted[i] = 0.05 + 0.9*rng.Float64()
+		expected[i] = 0.02
+		if i == label {
+			expected[i] = 1 - 0.02*float64(n-1)
+		}
+	}
+	return predicted, expected
+}
+
+// checkGradients compares gradients against the central differences of loss
+// wrt each of inputs.
+func checkGradients(t *testing.T, name string, inputs, gradients []float64, loss func() float64) {
+	const h = 1e-6
+	for i := range inputs {
+		x := inputs[i]
+		inputs[i] = x + h
+		plus := loss()
+		inputs[i] = x - h
+		minus := loss()
+		inputs[i] = x
+
+		numeric := (plus - minus) / (2 * h)
+		if diff := math.Abs(numeric - gradients[i]); diff > 1e-5*math.Max(1, math.Abs(numeric)) {
+			t.Errorf("%s, output %d: gradient %v, numeric gradient is %v", name, i, gradients[i], numeric)
+		}
+	}
+}
+
+func TestLossGradients(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	gamma, alpha, zero := 0.5, 0.6, 0.0
+	confs := []LossConf{{}, {Delta: 0.3, Gamma: &gamma, Alpha: &alpha}, {Gamma: &zero, Alpha: &zero}}
+
+	for _, lossType := range allLosses {
+		for _, conf := range confs {
+			loss := newLoss(lossType, conf)
+			for trial := 0; trial < 5; trial++ {
+				predicted, expected := lossSample(rng, 6)
+				gradients := make([]float64, len(predicted))
+				loss.LossGradients(predicted, expected, gradients)
+
+				checkGradients(t, fmt.Sprintf("loss %d", lossType), predicted, gradients, func() float64 {
+					return loss.LossFunction(predicted, expected)
+				})
+			}
+		}
+	}
+}
+
+// TestFusedLossGradients checks the logit gradients against the loss computed
+// from the logits, and that the latter matches the loss on the activations.
+func TestFusedLossGradients(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	fused := []struct {
+		loss IFusedLoss
+		act  IActivation
+	}{
+		{SoftmaxCrossEntropy{}, SoftmaxActivation{}},
+		{SigmoidBinaryCrossEntropy{}, SigmoidActivation{}},
+	}
+
+	for _, f := range fused {
+		for trial := 0; trial < 5; trial++ {
+			logits := awayFromKinks(rng, 5)
+			_, expected := lossSample(rng, 5)
+			outputs := make([]float64, len(logits))
+			f.act.Activate(logits, outputs)
+
+			gradients := make([]float64, len(logits))
+			f.loss.LogitGradients(outputs, expected, gradients)
+			checkGradients(t, "fused loss", logits, gradients, func() float64 {
+				return f.loss.LogitLoss(logits, expected)
+			})
+
+			fromLogits := f.loss.LogitLoss(logits, expected)
+			fromOutputs := f.loss.LossFunction(outputs, expected)
+			if math.Abs(fromLogits-fromOutputs) > 1e-9 {
+				t.Errorf("loss from logits is %v, from outputs %v", fromLogits, fromOutputs)
+			}
+		}
+	}
+}
+
+func TestFusedLossSaturated(t *testing.T) {
+	loss := SoftmaxCrossEntropy{}.LogitLoss([]float64{1000, -1000, 0}, []float64{0, 1, 0})
+	if loss != 2000 {
+		t.Errorf("softmax cross entropy of saturated logits is %v, want 2000", loss)
+	}
+	loss = SigmoidBinaryCrossEntropy{}.LogitLoss([]float64{1000, -1000}, []float64{0, 1})
+	if loss != 2000 {
+		t.Errorf("sigmoid binary cross entropy of saturated logits is %v, want 2000", loss)
+	}
+}
+
+// TestLossSaturated checks that the unfused cross entropies stay finite on
+// outputs at 0 and 1.
+func TestLossSaturated(t *testing.T) {
+	predicted, expected := []float64{0, 1, 1}, []float64{1, 0, 0.5}
+	for _, loss := range []ILoss{CrossEntropy{}, BinaryCrossEntropy{}} {
+		value := loss.LossFunction(predicted, expected)
+		if math.IsNaN(value) || math.IsInf(value, 0) || value < 69 {
+			t.Errorf("%T of saturated outputs is %v, want a large finite loss", loss, value)
+		}
+
+		gradients := make([]float64, len(predicted))
+		loss.LossGradients(predicted, expected, gradients)
+		for i, g := range gradients {
+			if math.IsNaN(g) || math.IsInf(g, 0) {
+				t.Errorf("%T gradient %d of saturated outputs is %v", loss, i, g)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package neuralnetwork
+
+// Matrix is a dense row-major matrix. Batches are stored one sample per row.
+type Matrix struct {
+	Rows, Cols int
+	Data       []float64
+}
+
+func NewMatrix(rows, cols int) *Matrix {
+	return &Matrix{Rows: rows, Cols: cols, Data: make([]float64, rows*cols)}
+}
+
+func (m *Matrix) Row(i int) []float64 {
+	return m.Data[i*m.Cols : (i+1)*m.Cols]
+}
+
+func (m *Matrix) Zero() {
+	for i := range m.Data {
+		m.Data[i] = 0
+	}
+}
+
+// reshape resizes m in place, reusing its backing array when it is large
+// enough. The values are not kept when it has to grow.
+func (m *Matrix) reshape(rows, cols int) {
+	size := rows * cols
+	if cap(m.Data) < size {
+		m.Data = make([]float64, size)
+	}
+	m.Rows, m.Cols, m.Data = rows, cols, m.Data[:size]
+}
+
+// transposeInto writes the transpose of m into dst, allocating dst when it
+// is nil.
+func (m *Matrix) transposeInto(dst *Matrix) *Matrix {
+	if dst == nil {
+		dst = NewMatrix(m.Cols, m.Rows)
+	}
+	dst.reshape(m.Cols, m.Rows)
+
+	const block = 32
+	for i0 := 0; i0 < m.Rows; i0 += block {
+		iMax := minInt(i0+block, m.Rows)
+		for j0 := 0; j0 < m.Cols; j0 += block {
+			jMax := minInt(j0+block, m.Cols)
+			for i := i0; i < iMax; i++ {
+				for j := j0; j < jMax; j++ {
+					dst.Data[j*dst.Cols+i] = m.Data[i*m.Cols+j]
+				}
+			}
+		}
+	}
+	return dst
+}
+
+const (
+	gemmTile   = 4
+	gemmKBlock = 256
+)
+
+// gemmABt computes c = a * bᵀ, or adds it to c when accumulate is set. Both
+// operands are walked along their rows, so every inner loop is contiguous.
+// Rows of c are split between the workers, which never share an output.
+// They get whole tiles, so which rows go through gemmTile4, and the order
+// their sums are rounded in, doesn't depend on the number of workers.
+func gemmABt(a, b, c *Matrix, accumulate bool) {
+	assert(a.Cols == b.Cols && c.Rows == a.Rows && c.Cols == b.Rows, "gemm shape mismatch")
+	if !accumulate {
+		c.Zero()
+	}
+
+	numTiles := (a.Rows + gemmTile - 1) / gemmTile
+	parallelChunks(numTiles, func(_, startTile, endTile int) {
+		start, end := startTile*gemmTile, minInt(endTile*gemmTile, a.Rows)
+		for k0 := 0; k0 < a.Cols; k0 += gemmKBlock {
+			kMax := minInt(k0+gemmKBlock, a.Cols)
+			for i := start; i < end; i += gemmTile {
+				if i+gemmTile > end {
+					for ii := i; ii < end; ii++ {
+						gemmRow(a.Row(ii)[k0:kMax], b, c.Row(ii), k0, kMax)
+					}
+					break
+				}
+				gemmTile4(a, b, c, i, k0, kMax)
+			}
+		}
+	})
+}
+
+// gemmTile4 accumulates a 4x4 block of c at a time, reusing every loaded
+// value of a and b four times.
+func gemmTile4(a, b, c *Matrix, i, k0, kMax int) {
+	a0, a1 := a.Row(i)[k0:kMax], a.Row(i + 1)[k0:kMax]
+	a2, a3 := a.Row(i + 2)[k0:kMax], a.Row(i + 3)[k0:kMax]
+	c0, c1, c2, c3 := c.Row(i), c.Row(i+1), c.Row(i+2), c.Row(i+3)
+
+	j := 0
+	for ; j+gemmTile <= b.Rows; j += gemmTile {
+		b0, b1 := b.Row(j)[k0:kMax], b.Row(j + 1)[k0:kMax]
+		b2, b3 := b.Row(j + 2)[k0:kMax], b.Row(j + 3)[k0:kMax]
+
+		var s00, s01, s02, s03, s10, s11, s12, s13 float64
+		var s20, s21, s22, s23, s30, s31, s32, s33 float64
+		for k := range a0 {
+			x0, x1, x2, x3 := a0[k], a1[k], a2[k], a3[k]
+			y0, y1, y2, y3 := b0[k], b1[k], b2[k], b3[k]
+			s00 += x0 * y0
+			s01 += x0 * y1
+			s02 += x0 * y2
+			s03 += x0 * y3
+			s10 += x1 * y0
+			s11 += x1 * y1
+			s12 += x1 * y2
+			s13 += x1 * y3
+			s20 += x2 * y0
+			s21 += x2 * y1
+			s22 += x2 * y2
+			s23 += x2 * y3
+			s30 += x3 * y0
+			s31 += x3 * y1
+			s32 += x3 * y2
+			s33 += x3 * y3
+		}
+
+		c0[j] += s00
+		c0[j+1] += s01
+		c0[j+2] += s02
+		c0[j+3] += s03
+		c1[j] += s10
+		c1[j+1] += s11
+		c1[j+2] += s12
+		c1[j+3] += s13
+		c2[j] += s20
+		c2[j+1] += s21
+		c2[j+2] += s22
+		c2[j+3] += s23
+		c3[j] += s30
+		c3[j+1] += s31
+		c3[j+2] += s32
+		c3[j+3] += s33
+	}
+
+	for ; j < b.Rows; j++ {
+		bj := b.Row(j)[k0:kMax]
+		c0[j] += dot(a0, bj)
+		c1[j] += dot(a1, bj)
+		c2[j] += dot(a2, bj)
+		c3[j] += dot(a3, bj)
+	}
+}
+
+func gemmRow(ai []float64, b *Matrix, ci []float64, k0, kMax int) {
+	for j := 0; j < b.Rows; j++ {
+		ci[j] += dot(ai, b.Row(j)[k0:kMax])
+	}
+}
+
+func dot(x, y []float64) float64 {
+	y = y[:len(x)]
+	var s0, s1, s2, s3 float64
+	k := 0
+	for ; k+4 <= len(x); k += 4 {
+		s0 += x[k] * y[k]
+		s1 += x[k+1] * y[k+1]
+		s2 += x[k+2] * y[k+2]
+		s3 += x[k+3] * y[k+3]
+	}
+	for ; k < len(x); k++ {
+		s0 += x[k] * y[k]
+	}
+	return (s0 + s1) + (s2 + s3)
+}
@@ -0,0 +1,125 @@
+package neuralnetwork
+
+import "fmt"
+
+// MultiLabelEvaluation scores predictions where every sample can have any
+// number of labels. SubsetAccuracy counts samples with all their labels
+// right, HammingLoss is the fraction of wrong label decisions.
+type MultiLabelEvaluation struct {
+	SubsetAccuracy float64   `json:"subset_accuracy"`
+	HammingLoss    float64   `json:"hamming_loss"`
+	MicroF1        float64   `json:"micro_f1"`
+	MacroF1        float64   `json:"macro_f1"`
+	LabelF1        []float64 `json:"label_f1"`
+	Total          int       `json:"total"`
+}
+
+func NewMultiLabelEvaluation(predictions, targets [][]bool) *MultiLabelEvaluation {
+	assert(len(predictions) == len(targets), "predictions and targets have different lengths")
+	eval := &MultiLabelEvaluation{Total: len(targets)}
+	if len(targets) == 0 {
+		return eval
+	}
+
+	numLabels := len(targets[0])
+	tp := make([]int, numLabels)
+	fp := make([]int, numLabels)
+	fn := make([]int, numLabels)
+	exact, wrong := 0, 0
+	for s, target := range targets {
+		allRight := true
+		for j, expected := range target {
+			predicted := predictions[s][j]
+			switch {
+			case predicted && expected:
+				tp[j]++
+			case predicted:
+				fp[j]++
+			case expected:
+				fn[j]++
+			}
+			if predicted != expected {
+				allRight = false
+				wrong++
+			}
+		}
+		if allRight {
+			exact++
+		}
+	}
+
+	eval.SubsetAccuracy = float64(exact) / float64(len(targets))
+	eval.HammingLoss = float64(wrong) / float64(len(targets)*numLabels)
+
+	eval.LabelF1 = make([]float64, numLabels)
+	sumTP, sumFP, sumFN := 0, 0, 0
+	for j := range eval.LabelF1 {
+		eval.LabelF1[j] = safeDiv(float64(2*tp[j]), float64(2*tp[j]+fp[j]+fn[j]))
+		eval.MacroF1 += eval.LabelF1[j] / float64(numLabels)
+		sumTP, sumFP, sumFN = sumTP+tp[j], sumFP+fp[j], sumFN+fn[j]
+	}
+	eval.MicroF1 = safeDiv(float64(2*sumTP), float64(2*sumTP+sumFP+sumFN))
+	return eval
+}
+
+func (eval *MultiLabelEvaluation) GetScoreString() string {
+	return fmt.Sprintf("Subset accuracy %.4f%%, Hamming loss %.4f, micro F1 %.4f, macro F1 %.4f over %d samples",
+		eval.SubsetAccuracy*100, eval.HammingLoss, eval.MicroF1, eval.MacroF1, eval.Total)
+}
+
+// applyThresholds decides every label, outputs at or above their threshold
+// being predicted. Missing thresholds default to 0.5.
+func applyThresholds(outputs, thresholds []float64) []bool {
+	decisions := make([]bool, len(outputs))
+	for i, output := range outputs {
+		threshold := 0.5
+		if i < len(thresholds) {
+			threshold = thresholds[i]
+		}
+		decisions[i] = output >= threshold
+	}
+	return decisions
+}
+
+// PredictLabels returns every label whose output reaches its threshold.
+func (nn *NeuralNetwork) PredictLabels(inputs, thresholds []float64) []int {
+	labels := []int{}
+	for label, predicted := range applyThresholds(nn.CalculateOutputs(inputs), thresholds) {
+		if predicted {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+func (t *Trainer) PredictLabels(inputs []float64) []int {
+	return t.NN.PredictLabels(inputs, t.Config.Thresholds)
+}
+
+func (t *Trainer) EvalMultiLabel(useEvalData bool) *MultiLabelEvaluation {
+	if useEvalData {
+		return t.EvaluateMultiLabel(t.validationData)
+	}
+	return t.EvaluateMultiLabel(t.trainingData)
+}
+
+func (t *Trainer) EvaluateMultiLabel(data []DataPoint) *MultiLabelEvaluation {
+	predictions := make([][]bool, len(data))
+	targets := make([][]bool, len(data))
+	for i, dp := range data {
+		predictions[i] = applyThresholds(t.NN.CalculateOutputs(dp.inputs), t.Config.Thresholds)
+		targets[i] = applyThresholds(dp.expectedOutputs, nil)
+	}
+	return NewMultiLabelEvaluation(predictions, targets)
+}
+
+// TuneThresholds picks the threshold of every label that maximizes metric
+// over data, and uses them from then on.
+func (t *Trainer) TuneThresholds(data []DataPoint, metric ThresholdMetric) []float64 {
+	thresholds := make([]float64, len(data[0].expectedOutputs))
+	for label := range thresholds {
+		thresholds[label], _ = t.AnalyzeClass(data, label).BestThreshold(metric)
+	}
+	t.Config.Thresholds = thresholds
+	return thresholds
+}
@@ -1,8 +1,9 @@
 package neuralnetwork
 
 import (
+	"encoding/json"
+	"fmt"
 	"math/rand"
-	"time"
 )
 
 type NNConf struct {
@@ -11,14 +12,83 @@ type NNConf struct {
 	Activation    ActivationType `json:"hidden_activations"`
 	OutActivation ActivationType `json:"output_activation"`
 	Loss          LossType       `json:"loss"`
+	// LossConf holds the parameters of the Huber and focal losses.
+	LossConf LossConf `json:"loss_conf"`
+	// ClassWeights scale the loss of each class's samples, so rare classes
+	// can weigh as much as common ones.
+	ClassWeights []float64 `json:"class_weights,omitempty"`
+	// LabelSmoothing moves this much of the expected probability off the
+	// right class and spreads it evenly over all of them.
+	LabelSmoothing float64 `json:"label_smoothing,omitempty"`
+	// Initializer sets up the weights of the dense layers built from
+	// LayerSizes, Auto_I by default.
+	Initializer InitConf `json:"initializer"`
+	// Seed drives the weight initialization and dropout, 0 seeds from the
+	// time.
+	Seed int64 `json:"seed,omitempty"`
+	// ActivationAlpha configures the hidden activations, see LayerConf.
+	ActivationAlpha float64 `json:"activation_alpha,omitempty"`
+
+	// Dropout holds the dropout rate of each hidden layer, in order.
+	Dropout []float64 `json:"dropout,omitempty"`
+	// BatchNorm normalizes the activations of every hidden layer.
+	BatchNorm bool `json:"batch_norm,omitempty"`
+
+	// Layers stacks arbitrary layers instead of building dense layers from
+	// LayerSizes. Their input is InputShape for image models, or a flat
+	// vector of InputSize values.
+	InputSize  int         `json:"-"`
+	InputShape Shape       `json:"-"`
+	Layers     []LayerConf `json:"-"`
+}
+
+// layerConfs expands LayerSizes into dense layers, each hidden one followed
+// by its batch norm and dropout layers when configured.
+func (conf NNConf) layerConfs() []LayerConf {
+	if len(conf.Layers) > 0 {
+		return conf.Layers
+	}
+
+	numLayers := len(conf.LayerSizes) - 1
+	assert(len(conf.Dropout) < numLayers, "dropout is only supported on hidden layers")
+
+	layers := []LayerConf{}
+	for i := 1; i < numLayers; i++ {
+		layers = append(layers, LayerConf{Type: Dense_L, Size: conf.LayerSizes[i], Activation: conf.Activation, ActivationAlpha: conf.ActivationAlpha, Init: conf.Initializer})
+		if conf.BatchNorm {
+			layers = append(layers, LayerConf{Type: BatchNorm_L})
+		}
+		if i-1 < len(conf.Dropout) && conf.Dropout[i-1] > 0 {
+			layers = append(layers, LayerConf{Type: Dropout_L, Rate: conf.Dropout[i-1]})
+		}
+	}
+	return append(layers, LayerConf{Type: Dense_L, Size: conf.LayerSizes[numLayers], Activation: conf.OutActivation, Init: conf.Initializer})
+}
+
+func (conf NNConf) inputShape() Shape {
+	if len(conf.Layers) == 0 {
+		return FlatShape(conf.LayerSizes[0])
+	}
+	if conf.InputShape.Size() > 0 {
+		return conf.InputShape
+	}
+	return FlatShape(conf.InputSize)
 }
 
 type NeuralNetwork struct {
-	Layers []*Layer `json:"layers"`
-	Loss   ILoss    `json:"-"`
+	Layers    []LayerI   `json:"-"`
+	Loss      ILoss      `json:"-"`
+	Optimizer IOptimizer `json:"-"`
 	*History
 
 	Config NNConf `json:"config"`
+
+	// learnData is the training scratch, created on the first Learn call.
+	learnData *NetworkLearnData
+	// rng draws the dropout masks. Its source's state is saved in
+	// checkpoints.
+	rng       *rand.Rand
+	rngSource *rngSource
 }
 
 func NewNN(conf NNConf, history *History) *NeuralNetwork {
@@ -27,78 +97,120 @@ func NewNN(conf NNConf, history *History) *NeuralNetwork {
 		History: history,
 	}
 
-	nn.Layers = make([]*Layer, len(conf.LayerSizes)-1)
-	for i := 0; i < len(nn.Layers); i++ {
-		nn.Layers[i] = NewLayer(conf.LayerSizes[i], conf.LayerSizes[i+1], rand.New(rand.NewSource(time.Now().UnixNano())))
+	rng := newRand(conf.Seed)
+	shape := conf.inputShape()
+	for _, layerConf := range conf.layerConfs() {
+		var layer LayerI
+		layer, shape = newLayerFromConf(layerConf, shape, rng)
+		nn.Layers = append(nn.Layers, layer)
 	}
+	nn.setRNGState(uint64(rng.Int63()))
 
-	nn.SetActivationFns(conf.Activation, conf.OutActivation)
 	nn.SetLossFns(conf.Loss)
+	nn.SetOptimizer(GetOptimizerFromType(SGD_O, OptimizerConf{}))
 
 	return nn
 }
 
+// SetActivationFns sets act on every dense layer but the last, which gets
+// outAct.
 func (nn *NeuralNetwork) SetActivationFns(act, outAct ActivationType) {
+	dense := []*DenseLayer{}
 	for _, layer := range nn.Layers {
+		if l, ok := layer.(*DenseLayer); ok {
+			dense = append(dense, l)
+		}
+	}
+
+	for _, layer := range dense {
 		layer.SetActivation(act)
 	}
-	nn.Layers[len(nn.Layers)-1].SetActivation(outAct)
+	dense[len(dense)-1].SetActivation(outAct)
 }
 
-func (nn *NeuralNetwork) SetLossFns(lossType LossType) {
-	nn.Loss = GetLossFromType(lossType)
+// outputLayer is a layer applying its activation to weighted inputs, which
+// lets a fused loss work on them.
+type outputLayer interface {
+	LayerI
+	activationType() ActivationType
+	calculateWeightedInputs(inputs, weightedInputs []float64)
 }
 
-var batchLearnData []*NetworkLearnData = nil
-
-func (nn *NeuralNetwork) Learn(trainingData []DataPoint, rate, regularization, momentum float64) {
-	if batchLearnData == nil || len(batchLearnData) != len(trainingData) {
-		batchLearnData = make([]*NetworkLearnData, len(trainingData))
-		// debug(trainingData)
-		for i := range batchLearnData {
-			batchLearnData[i] = NewNetworkLearnData(nn.Layers)
+// SetLossFns sets the loss, fused with the output activation when the two
+// match, like softmax with cross entropy.
+func (nn *NeuralNetwork) SetLossFns(lossType LossType) {
+	nn.Loss = newLoss(lossType, nn.Config.LossConf)
+	if out, ok := nn.Layers[len(nn.Layers)-1].(outputLayer); ok {
+		if fused := getFusedLoss(lossType, out.activationType()); fused != nil {
+			nn.Loss = fused
 		}
 	}
+}
 
-	done := make(chan bool)
-	for i, dataP := range trainingData {
-		go func(i int, data DataPoint) {
-			nn.UpdateGradients(data, batchLearnData[i])
-			done <- true
-		}(i, dataP)
-	}
-
-	for i := 0; i < len(trainingData); i++ {
-		<-done
-	}
+// setRNGState restarts the dropout generator at state. The learn data keeps
+// the old generator, so it is dropped too.
+func (nn *NeuralNetwork) setRNGState(state uint64) {
+	nn.rngSource = &rngSource{state: state}
+	nn.rng = rand.New(nn.rngSource)
+	nn.learnData = nil
+}
 
-	for _, layer := range nn.Layers {
-		layer.ApplyGradient(rate/float64(len(trainingData)), regularization, momentum)
+// ensureRNG seeds the dropout generator of loaded networks from the config.
+func (nn *NeuralNetwork) ensureRNG() {
+	if nn.rngSource == nil {
+		nn.setRNGState(uint64(newRand(nn.Config.Seed).Int63()))
 	}
+}
 
+func (nn *NeuralNetwork) SetOptimizer(optimizer IOptimizer) {
+	nn.Optimizer = optimizer
 }
 
-func (nn *NeuralNetwork) UpdateGradients(data DataPoint, learnData *NetworkLearnData) {
-	inputsToNextLayer := data.inputs
-	for i, layer := range nn.Layers {
-		inputsToNextLayer = layer.CalculateLearningOutputs(inputsToNextLayer, learnData.layerData[i])
+// Learn runs one mini-batch step. Each layer is computed for the whole batch
+// before moving to the next one, so layers like batch norm see every sample.
+func (nn *NeuralNetwork) Learn(trainingData []DataPoint, rate, regularization float64) {
+	if nn.learnData == nil {
+		nn.ensureRNG()
+		nn.learnData = NewNetworkLearnData(nn.Layers, len(trainingData), nn.rng)
 	}
+	learnData := nn.learnData
+	learnData.resize(len(trainingData))
 
-	// BackProp
-	outputLayerIndex := len(nn.Layers) - 1
-	outputLayer := nn.Layers[outputLayerIndex]
-	outputLearnData := learnData.layerData[outputLayerIndex]
-
-	outputLayer.CalculateOutputLayerNodeValues(outputLearnData, data.expectedOutputs, nn.Loss)
-	outputLayer.UpdateGradients(outputLearnData)
+	outputs := learnData.inputs
+	for s, dataP := range trainingData {
+		copy(outputs.Row(s), dataP.inputs)
+	}
+	for i, layer := range nn.Layers {
+		outputs = layer.Forward(outputs, learnData.layerData[i])
+	}
 
-	for i := outputLayerIndex - 1; i >= 0; i-- {
-		layerLearnData := learnData.layerData[i]
-		hiddenLayer := nn.Layers[i]
+	gradients := learnData.outputGradients
+	fused, _ := nn.Loss.(IFusedLoss)
+	learnData.layerData[len(nn.Layers)-1].logitGradients = fused != nil
+	parallelFor(len(trainingData), func(s int) {
+		predicted, grads := outputs.Row(s), gradients.Row(s)
+		expected, weight := nn.lossTarget(trainingData[s], learnData.targets.Row(s))
+		if fused != nil {
+			fused.LogitGradients(predicted, expected, grads)
+		} else {
+			nn.Loss.LossGradients(predicted, expected, grads)
+		}
+		if weight != 1 {
+			for i := range grads {
+				grads[i] *= weight
+			}
+		}
+	})
+	for i := len(nn.Layers) - 1; i >= 0; i-- {
+		gradients = nn.Layers[i].Backward(gradients, learnData.layerData[i])
+	}
 
-		hiddenLayer.CalculateHiddenLayerNodeValues(layerLearnData, nn.Layers[i+1], learnData.layerData[i+1].nodeValues)
-		hiddenLayer.UpdateGradients(layerLearnData)
+	for _, layer := range nn.Layers {
+		for _, param := range layer.Parameters() {
+			param.ApplyGradient(nn.Optimizer, rate, regularization, len(trainingData))
+		}
 	}
+
 }
 
 func (nn *NeuralNetwork) Classify(inputs []float64) (predictedClass int, outputs []float64) {
@@ -107,6 +219,21 @@ func (nn *NeuralNetwork) Classify(inputs []float64) (predictedClass int, outputs
 	return predictedClass, outputs
 }
 
+type Prediction struct {
+	Class       int     `json:"class"`
+	Probability float64 `json:"probability"`
+}
+
+// PredictTopK returns the k most likely classes, most likely first.
+func (nn *NeuralNetwork) PredictTopK(inputs []float64, k int) []Prediction {
+	outputs := nn.CalculateOutputs(inputs)
+	predictions := []Prediction{}
+	for _, class := range topK(outputs, k) {
+		predictions = append(predictions, Prediction{Class: class, Probability: outputs[class]})
+	}
+	return predictions
+}
+
 func (nn *NeuralNetwork) CalculateOutputs(inputs []float64) []float64 {
 	for _, layer := range nn.Layers {
 		inputs = layer.CalculateOutputs(inputs)
@@ -117,11 +244,159 @@ func (nn *NeuralNetwork) CalculateOutputs(inputs []float64) []float64 {
 func (nn *NeuralNetwork) calculateTotalLoss(batch []DataPoint) float64 {
 	totalLoss := 0.0
 
+	fused, _ := nn.Loss.(IFusedLoss)
+	targets := make([]float64, nn.Layers[len(nn.Layers)-1].NumOut())
 	for _, dataPoint := range batch {
+		expected, weight := nn.lossTarget(dataPoint, targets)
+		if fused != nil {
+			totalLoss += weight * fused.LogitLoss(nn.calculateLogits(dataPoint.inputs), expected)
+			continue
+		}
 		_, outputs := nn.Classify(dataPoint.inputs)
-		loss := nn.Loss.LossFunction(outputs, dataPoint.expectedOutputs)
-		totalLoss += loss
+		totalLoss += weight * nn.Loss.LossFunction(outputs, expected)
 	}
 
 	return totalLoss
 }
+
+// lossTarget returns the expected outputs the loss compares dataPoint's
+// outputs to, smoothed into targets when label smoothing is on, and the
+// weight of its loss. Both only apply to samples with a single class label.
+func (nn *NeuralNetwork) lossTarget(dataPoint DataPoint, targets []float64) (expected []float64, weight float64) {
+	expected, weight = dataPoint.expectedOutputs, 1.0
+	if dataPoint.label < 0 {
+		return expected, weight
+	}
+
+	if len(nn.Config.ClassWeights) > 0 {
+		weight = nn.Config.ClassWeights[dataPoint.label]
+	}
+	if smoothing := nn.Config.LabelSmoothing; smoothing > 0 {
+		for i, y := range expected {
+			targets[i] = (1-smoothing)*y + smoothing/float64(len(expected))
+		}
+		expected = targets
+	}
+	return expected, weight
+}
+
+// calculateLogits returns the weighted inputs of the output layer.
+func (nn *NeuralNetwork) calculateLogits(inputs []float64) []float64 {
+	last := len(nn.Layers) - 1
+	for _, layer := range nn.Layers[:last] {
+		inputs = layer.CalculateOutputs(inputs)
+	}
+	out := nn.Layers[last].(outputLayer)
+	logits := make([]float64, out.NumOut())
+	out.calculateWeightedInputs(inputs, logits)
+	return logits
+}
+
+func (nn *NeuralNetwork) copyParams() [][]float64 {
+	params := [][]float64{}
+	for _, layer := range nn.Layers {
+		for _, p := range layer.Parameters() {
+			params = append(params, append([]float64(nil), p.Values...))
+		}
+	}
+	return params
+}
+
+func (nn *NeuralNetwork) loadParams(params [][]float64) {
+	i := 0
+	for _, layer := range nn.Layers {
+		for _, p := range layer.Parameters() {
+			copy(p.Values, params[i])
+			i++
+		}
+	}
+}
+
+func (nn *NeuralNetwork) optimizerStates() [][]*OptimizerState {
+	states := make([][]*OptimizerState, len(nn.Layers))
+	for i, layer := range nn.Layers {
+		for _, p := range layer.Parameters() {
+			states[i] = append(states[i], p.State)
+		}
+	}
+	return states
+}
+
+func (nn *NeuralNetwork) setOptimizerStates(states [][]*OptimizerState) error {
+	if len(states) != len(nn.Layers) {
+		return fmt.Errorf("optimizer state for %d layers, network has %d", len(states), len(nn.Layers))
+	}
+
+	for i, layer := range nn.Layers {
+		params := layer.Parameters()
+		if len(states[i]) != len(params) {
+			return fmt.Errorf("optimizer state mismatch on layer %d", i)
+		}
+		for j, p := range params {
+			if p.State != nil && states[i][j] != nil {
+				*p.State = *states[i][j]
+			}
+		}
+	}
+	return nil
+}
+
+type nnJSON struct {
+	Layers []json.RawMessage `json:"layers"`
+	*History
+	Config NNConf `json:"config"`
+}
+
+// MarshalJSON records the type of every layer next to its fields.
+func (nn *NeuralNetwork) MarshalJSON() ([]byte, error) {
+	data := nnJSON{History: nn.History, Config: nn.Config}
+	for _, layer := range nn.Layers {
+		layerData, err := marshalLayer(layer)
+		if err != nil {
+			return nil, err
+		}
+		data.Layers = append(data.Layers, layerData)
+	}
+	return json.Marshal(data)
+}
+
+// UnmarshalJSON restores the layers and their activations. Networks saved
+// before layers had a type only hold dense layers, their activations come
+// from the config.
+func (nn *NeuralNetwork) UnmarshalJSON(jsonData []byte) error {
+	data := nnJSON{History: &History{}}
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return err
+	}
+
+	nn.Layers = nil
+	nn.learnData = nil
+	nn.rng, nn.rngSource = nil, nil
+	legacy := false
+	for _, layerData := range data.Layers {
+		layer, isLegacy, err := unmarshalLayer(layerData)
+		if err != nil {
+			return err
+		}
+		legacy = legacy || isLegacy
+		switch l := layer.(type) {
+		case *DenseLayer:
+			l.SetActivation(l.Activation)
+		case *Conv2DLayer:
+			l.SetActivation(l.Activation)
+		}
+		layer.InitLearningState()
+		nn.Layers = append(nn.Layers, layer)
+	}
+	if len(nn.Layers) == 0 {
+		return fmt.Errorf("network has no layers")
+	}
+
+	nn.History = data.History
+	nn.Config = data.Config
+	if legacy {
+		nn.SetActivationFns(nn.Config.Activation, nn.Config.OutActivation)
+	}
+	nn.SetLossFns(nn.Config.Loss)
+	return nil
+}
@@ -0,0 +1,177 @@
+package neuralnetwork
+
+import (
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// blobs returns numLabels well separated clusters of 2D points.
+func blobs(rng *rand.Rand, n, numLabels int) []DataPoint {
+	data := make([]DataPoint, n)
+	for i := range data {
+		label := rng.Intn(numLabels)
+		inputs := []float64{
+			float64(label) + rng.NormFloat64()*0.2,
+			float64(numLabels-label) + rng.NormFloat64()*0.2,
+		}
+		data[i] = NewDataPoint(inputs, label, numLabels)
+	}
+	return data
+}
+
+// TestTrainConcurrently trains several networks at once, each with its own
+// batch size so the last batch is short. Run it with -race.
+func TestTrainConcurrently(t *testing.T) {
+	const numNetworks, epochs = 4, 3
+
+	var wg sync.WaitGroup
+	trainers := make([]*Trainer, numNetworks)
+	for i := range trainers {
+		rng := rand.New(rand.NewSource(int64(i)))
+		trainers[i] = NewTrainer(TrainerConf{
+			BatchSize: 16 + 5*i,
+			Epochs:    epochs,
+			Rate:      0.05,
+			Optimizer: Adam_O,
+		})
+		trainers[i].NNInit(NNConf{
+			LayerSizes:    []int{2, 12, 3},
+			Activation:    ReLU,
+			OutActivation: Softmax,
+			Loss:          CrossEntropy_T,
+			Dropout:       []float64{0.1},
+			BatchNorm:     true,
+		})
+		trainers[i].LoadCustomData(blobs(rng, 300, 3), blobs(rng, 100, 3))
+
+		wg.Add(1)
+		go func(trainer *Trainer) {
+			defer wg.Done()
+			trainer.Train()
+		}(trainers[i])
+	}
+	wg.Wait()
+
+	for i, trainer := range trainers {
+		if len(trainer.History.Acc) != epochs {
+			t.Fatalf("network %d: got %d epochs of history, want %d", i, len(trainer.History.Acc), epochs)
+		}
+		if acc := trainer.Eval(true).GettAccuracy(); acc < 80 {
+			t.Errorf("network %d: validation accuracy %.2f%%, want at least 80%%", i, acc)
+		}
+	}
+}
+
+// trainSeeded trains a small convolutional network, with dropout and
+// reshuffled batches, using workers goroutines, and returns its parameters.
+func trainSeeded(seed int64, workers int) [][]float64 {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(workers))
+
+	rng := rand.New(rand.NewSource(1))
+	data := make([]DataPoint, 200)
+	for i := range data {
+		label := rng.Intn(2)
+		inputs := make([]float64, 36)
+		for j := range inputs {
+			inputs[j] = rng.NormFloat64() + float64(label)
+		}
+		data[i] = NewDataPoint(inputs, label, 2)
+	}
+
+	trainer := NewTrainer(TrainerConf{
+		TrainingSplit: 0.8,
+		BatchSize:     37,
+		Epochs:        2,
+		Rate:          0.01,
+		Optimizer:     Adam_O,
+		Sampler:       ShuffleSampler{},
+		Seed:          seed,
+	})
+	trainer.NNInit(NNConf{
+		InputShape: Shape{1, 6, 6},
+		Loss:       CrossEntropy_T,
+		Layers: []LayerConf{
+			{Type: Conv2D_L, Filters: 3, KernelSize: 3, Activation: ReLU},
+			{Type: Flatten_L},
+			{Type: Dense_L, Size: 8, Activation: TanH},
+			{Type: Dropout_L, Rate: 0.2},
+			{Type: Dense_L, Size: 2, Activation: Softmax},
+		},
+	})
+	trainer.LoadCustomData(trainer.SplitData(data))
+	trainer.Train()
+	return trainer.NN.copyParams()
+}
+
+// TestSeedReproducible checks that runs with the same seed end with the same
+// weights, even when spread over a different number of goroutines.
+func TestSeedReproducible(t *testing.T) {
+	want := trainSeeded(42, 1)
+	for _, workers := range []int{1, 3, 8} {
+		got := trainSeeded(42, workers)
+		for i := range want {
+			for j := range want[i] {
+				if got[i][j] != want[i][j] {
+					t.Fatalf("%d workers: parameter %d/%d is %v, want %v", workers, i, j, got[i][j], want[i][j])
+				}
+			}
+		}
+	}
+
+	other := trainSeeded(43, 1)
+	if other[0][0] == want[0][0] {
+		t.Errorf("different seeds gave the same weights")
+	}
+}
+
+// trainResumable trains a network with dropout for 3 epochs, from the
+// checkpoint file of dir named resumeFrom when not empty.
+func trainResumable(t *testing.T, dir, resumeFrom string) [][]float64 {
+	rng := rand.New(rand.NewSource(3))
+	trainer := NewTrainer(TrainerConf{
+		BatchSize:  10,
+		Epochs:     3,
+		Rate:       0.05,
+		Optimizer:  Adam_O,
+		Sampler:    ShuffleSampler{},
+		Seed:       7,
+		Checkpoint: &CheckpointConf{Dir: dir, EveryEpochs: 1, EveryBatches: 4},
+	})
+	trainer.NNInit(NNConf{
+		LayerSizes:    []int{2, 12, 3},
+		Activation:    ReLU,
+		OutActivation: Softmax,
+		Loss:          CrossEntropy_T,
+		Dropout:       []float64{0.3},
+	})
+	trainer.LoadCustomData(blobs(rng, 95, 3), blobs(rng, 30, 3))
+
+	if resumeFrom != "" {
+		if err := trainer.ResumeFromCheckpoint(filepath.Join(dir, resumeFrom)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trainer.Train()
+	return trainer.NN.copyParams()
+}
+
+// TestResumeWithDropout checks that resuming from a checkpoint, mid-epoch or
+// between epochs, ends with the weights of the uninterrupted run.
+func TestResumeWithDropout(t *testing.T) {
+	dir := t.TempDir()
+	want := trainResumable(t, dir, "")
+
+	for _, name := range []string{"checkpoint-e0001-b000004.json", "checkpoint-e0002-b000000.json"} {
+		got := trainResumable(t, dir, name)
+		for i := range want {
+			for j := range want[i] {
+				if got[i][j] != want[i][j] {
+					t.Fatalf("resumed from %s: parameter %d/%d is %v, want %v", name, i, j, got[i][j], want[i][j])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package neuralnetwork
+
+import "math"
+
+type OptimizerType int
+
+const (
+	SGD_O OptimizerType = iota
+	Nesterov_O
+	Adam_O
+	AdamW_O
+	RMSProp_O
+	AdaGrad_O
+)
+
+// IOptimizer updates params in place from the batch-averaged grads.
+// decay reports whether regularization applies to these params (weights only).
+type IOptimizer interface {
+	Update(params, grads []float64, state *OptimizerState, learnRate, regularization float64, decay bool)
+}
+
+// OptimizerState is the per-parameter memory an optimizer keeps on a layer.
+type OptimizerState struct {
+	Step   int       `json:"step"`
+	First  []float64 `json:"first"`
+	Second []float64 `json:"second"`
+}
+
+func NewOptimizerState(size int) *OptimizerState {
+	return &OptimizerState{
+		First:  make([]float64, size),
+		Second: make([]float64, size),
+	}
+}
+
+type OptimizerConf struct {
+	Momentum     float64
+	Beta1, Beta2 float64
+	Epsilon      float64
+}
+
+func GetOptimizerFromType(optimizerType OptimizerType, conf OptimizerConf) IOptimizer {
+	if conf.Epsilon == 0 {
+		conf.Epsilon = 1e-8
+	}
+
+	switch optimizerType {
+	case SGD_O:
+		return MomentumSGD{Momentum: conf.Momentum}
+	case Nesterov_O:
+		return Nesterov{Momentum: conf.Momentum}
+	case Adam_O, AdamW_O:
+		if conf.Beta1 == 0 {
+			conf.Beta1 = 0.9
+		}
+		if conf.Beta2 == 0 {
+			conf.Beta2 = 0.999
+		}
+		return Adam{Beta1: conf.Beta1, Beta2: conf.Beta2, Epsilon: conf.Epsilon, Decoupled: optimizerType == AdamW_O}
+	case RMSProp_O:
+		if conf.Beta2 == 0 {
+			conf.Beta2 = 0.9
+		}
+		return RMSProp{Decay: conf.Beta2, Epsilon: conf.Epsilon}
+	case AdaGrad_O:
+		return AdaGrad{Epsilon: conf.Epsilon}
+	default:
+		panic("Unhandled optimizer type")
+	}
+}
+
+func l2Gradient(param, grad, regularization float64, decay bool) float64 {
+	if decay {
+		return grad + regularization*param
+	}
+	return grad
+}
+
+type MomentumSGD struct {
+	Momentum float64
+}
+
+func (o MomentumSGD) Update(params, grads []float64, state *OptimizerState, learnRate, regularization float64, decay bool) {
+	weightDecay := 1.0
+	if decay {
+		weightDecay = 1 - regularization*learnRate
+	}
+
+	for i := range params {
+		velocity := state.First[i]*o.Momentum - grads[i]*learnRate
+		state.First[i] = velocity
+		params[i] = params[i]*weightDecay + velocity
+	}
+}
+
+type Nesterov struct {
+	Momentum float64
+}
+
+func (o Nesterov) Update(params, grads []float64, state *OptimizerState, learnRate, regularization float64, decay bool) {
+	for i := range params {
+		grad := l2Gradient(params[i], grads[i], regularization, decay)
+		prevVelocity := state.First[i]
+		velocity := prevVelocity*o.Momentum - grad*learnRate
+
+		state.First[i] = velocity
+		params[i] += -o.Momentum*prevVelocity + (1+o.Momentum)*velocity
+	}
+}
+
+// Adam with Decoupled set is AdamW: weight decay is applied to the params
+// directly instead of being folded into the gradient moments.
+type Adam struct {
+	Beta1, Beta2 float64
+	Epsilon      float64
+	Decoupled    bool
+}
+
+func (o Adam) Update(params, grads []float64, state *OptimizerState, learnRate, regularization float64, decay bool) {
+	state.Step++
+	correction1 := 1 - math.Pow(o.Beta1, float64(state.Step))
+	correction2 := 1 - math.Pow(o.Beta2, float64(state.Step))
+
+	for i := range params {
+		grad := grads[i]
+		if !o.Decoupled {
+			grad = l2Gradient(params[i], grad, regularization, decay)
+		}
+
+		state.First[i] = o.Beta1*state.First[i] + (1-o.Beta1)*grad
+		state.Second[i] = o.Beta2*state.Second[i] + (1-o.Beta2)*grad*grad
+
+		mHat := state.First[i] / correction1
+		vHat := state.Second[i] / correction2
+		step := mHat / (math.Sqrt(vHat) + o.Epsilon)
+
+		if o.Decoupled && decay {
+			step += regularization * params[i]
+		}
+		params[i] -= learnRate * step
+	}
+}
+
+type RMSProp struct {
+	Decay   float64
+	Epsilon float64
+}
+
+func (o RMSProp) Update(params, grads []float64, state *OptimizerState, learnRate, regularization float64, decay bool) {
+	for i := range params {
+		grad := l2Gradient(params[i], grads[i], regularization, decay)
+		state.Second[i] = o.Decay*state.Second[i] + (1-o.Decay)*grad*grad
+		params[i] -= learnRate * grad / (math.Sqrt(state.Second[i]) + o.Epsilon)
+	}
+}
+
+type AdaGrad struct {
+	Epsilon float64
+}
+
+func (o AdaGrad) Update(params, grads []float64, state *OptimizerState, learnRate, regularization float64, decay bool) {
+	for i := range params {
+		grad := l2Gradient(params[i], grads[i], regularization, decay)
+		state.Second[i] += grad * grad
+		params[i] -= learnRate * grad / (math.Sqrt(state.Second[i]) + o.Epsilon)
+	}
+}
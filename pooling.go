@@ -0,0 +1,165 @@
+package neuralnetwork
+
+// Pool2DLayer downsamples every channel with PoolSize x PoolSize windows,
+// keeping either the maximum or the average of each window.
+type Pool2DLayer struct {
+	InShape  Shape `json:"in_shape"`
+	OutShape Shape `json:"out_shape"`
+	PoolSize int   `json:"pool_size"`
+	Stride   int   `json:"stride"`
+
+	layerType LayerType
+}
+
+func NewMaxPool2DLayer(inShape Shape, poolSize, stride int) *Pool2DLayer {
+	return newPool2DLayer(MaxPool2D_L, inShape, poolSize, stride)
+}
+
+func NewAvgPool2DLayer(inShape Shape, poolSize, stride int) *Pool2DLayer {
+	return newPool2DLayer(AvgPool2D_L, inShape, poolSize, stride)
+}
+
+// newPool2DLayer defaults the stride to the pool size, so windows don't
+// overlap.
+func newPool2DLayer(layerType LayerType, inShape Shape, poolSize, stride int) *Pool2DLayer {
+	if stride <= 0 {
+		stride = poolSize
+	}
+
+	l := &Pool2DLayer{
+		InShape:   inShape,
+		PoolSize:  poolSize,
+		Stride:    stride,
+		layerType: layerType,
+	}
+	l.OutShape = Shape{
+		Channels: inShape.Channels,
+		Height:   (inShape.Height-poolSize)/stride + 1,
+		Width:    (inShape.Width-poolSize)/stride + 1,
+	}
+	assert(l.OutShape.Height > 0 && l.OutShape.Width > 0, "pooling window is larger than its input")
+	return l
+}
+
+func (l *Pool2DLayer) Type() LayerType          { return l.layerType }
+func (l *Pool2DLayer) NumIn() int               { return l.InShape.Size() }
+func (l *Pool2DLayer) NumOut() int              { return l.OutShape.Size() }
+func (l *Pool2DLayer) Parameters() []*Parameter { return nil }
+func (l *Pool2DLayer) InitLearningState()       {}
+
+// pool writes the pooled values to outputs. For max pooling, argMax gets the
+// input index each output was taken from.
+func (l *Pool2DLayer) pool(inputs, outputs, argMax []float64) {
+	in, out := l.InShape, l.OutShape
+	windowSize := float64(l.PoolSize * l.PoolSize)
+
+	for c := 0; c < out.Channels; c++ {
+		for oy := 0; oy < out.Height; oy++ {
+			for ox := 0; ox < out.Width; ox++ {
+				best, bestIndex, sum := 0.0, -1, 0.0
+				for ky := 0; ky < l.PoolSize; ky++ {
+					for kx := 0; kx < l.PoolSize; kx++ {
+						index := in.index(c, oy*l.Stride+ky, ox*l.Stride+kx)
+						value := inputs[index]
+						sum += value
+						if bestIndex < 0 || value > best {
+							best, bestIndex = value, index
+						}
+					}
+				}
+
+				outIndex := out.index(c, oy, ox)
+				if l.layerType == MaxPool2D_L {
+					outputs[outIndex] = best
+					if argMax != nil {
+						argMax[outIndex] = float64(bestIndex)
+					}
+				} else {
+					outputs[outIndex] = sum / windowSize
+				}
+			}
+		}
+	}
+}
+
+func (l *Pool2DLayer) CalculateOutputs(inputs []float64) []float64 {
+	outputs := make([]float64, l.NumOut())
+	l.pool(inputs, outputs, nil)
+	return outputs
+}
+
+func (l *Pool2DLayer) Forward(inputs *Matrix, learnData *LayerLearnData) *Matrix {
+	learnData.allocCache(l.NumOut())
+
+	parallelFor(inputs.Rows, func(s int) {
+		l.pool(inputs.Row(s), learnData.outputs.Row(s), learnData.cache.Row(s))
+	})
+	return learnData.outputs
+}
+
+func (l *Pool2DLayer) Backward(outputGradients *Matrix, learnData *LayerLearnData) *Matrix {
+	if learnData.inputGradients == nil {
+		return nil
+	}
+
+	in, out := l.InShape, l.OutShape
+	windowSize := float64(l.PoolSize * l.PoolSize)
+
+	parallelFor(outputGradients.Rows, func(s int) {
+		inputGradients, grads := learnData.inputGradients.Row(s), outputGradients.Row(s)
+		for i := range inputGradients {
+			inputGradients[i] = 0
+		}
+
+		for c := 0; c < out.Channels; c++ {
+			for oy := 0; oy < out.Height; oy++ {
+				for ox := 0; ox < out.Width; ox++ {
+					outIndex := out.index(c, oy, ox)
+					grad := grads[outIndex]
+
+					if l.layerType == MaxPool2D_L {
+						inputGradients[int(learnData.cache.Row(s)[outIndex])] += grad
+						continue
+					}
+					for ky := 0; ky < l.PoolSize; ky++ {
+						for kx := 0; kx < l.PoolSize; kx++ {
+							inputGradients[in.index(c, oy*l.Stride+ky, ox*l.Stride+kx)] += grad / windowSize
+						}
+					}
+				}
+			}
+		}
+	})
+	return learnData.inputGradients
+}
+
+// FlattenLayer turns image-like data into a flat vector. The values are
+// already stored flat, so it only changes the shape seen by the next layer.
+type FlattenLayer struct {
+	InShape Shape `json:"in_shape"`
+}
+
+func NewFlattenLayer(inShape Shape) *FlattenLayer {
+	return &FlattenLayer{InShape: inShape}
+}
+
+func (l *FlattenLayer) Type() LayerType          { return Flatten_L }
+func (l *FlattenLayer) NumIn() int               { return l.InShape.Size() }
+func (l *FlattenLayer) NumOut() int              { return l.InShape.Size() }
+func (l *FlattenLayer) Parameters() []*Parameter { return nil }
+func (l *FlattenLayer) InitLearningState()       {}
+
+func (l *FlattenLayer) CalculateOutputs(inputs []float64) []float64 {
+	return inputs
+}
+
+func (l *FlattenLayer) Forward(inputs *Matrix, learnData *LayerLearnData) *Matrix {
+	return inputs
+}
+
+func (l *FlattenLayer) Backward(outputGradients *Matrix, learnData *LayerLearnData) *Matrix {
+	if learnData.inputGradients == nil {
+		return nil
+	}
+	return outputGradients
+}
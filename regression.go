@@ -0,0 +1,88 @@
+package neuralnetwork
+
+import (
+	"fmt"
+	"math"
+)
+
+// RegressionEvaluation holds the errors of real-valued predictions, averaged
+// over every output of every sample. R2 is the coefficient of determination,
+// averaged over the outputs.
+type RegressionEvaluation struct {
+	MSE   float64 `json:"mse"`
+	RMSE  float64 `json:"rmse"`
+	MAE   float64 `json:"mae"`
+	R2    float64 `json:"r2"`
+	Total int     `json:"total"`
+}
+
+func NewRegressionEvaluation(predictions, targets [][]float64) *RegressionEvaluation {
+	assert(len(predictions) == len(targets), "predictions and targets have different lengths")
+	eval := &RegressionEvaluation{Total: len(targets)}
+	if len(targets) == 0 {
+		return eval
+	}
+
+	numOutputs := len(targets[0])
+	means := make([]float64, numOutputs)
+	for _, target := range targets {
+		for j, y := range target {
+			means[j] += y / float64(len(targets))
+		}
+	}
+
+	residuals := make([]float64, numOutputs)
+	variances := make([]float64, numOutputs)
+	for s, target := range targets {
+		for j, y := range target {
+			diff := predictions[s][j] - y
+			eval.MSE += diff * diff
+			eval.MAE += math.Abs(diff)
+			residuals[j] += diff * diff
+			variances[j] += (y - means[j]) * (y - means[j])
+		}
+	}
+
+	count := float64(len(targets) * numOutputs)
+	eval.MSE /= count
+	eval.MAE /= count
+	eval.RMSE = math.Sqrt(eval.MSE)
+
+	for j := range residuals {
+		eval.R2 += outputR2(residuals[j], variances[j]) / float64(numOutputs)
+	}
+	return eval
+}
+
+// outputR2 is 1 - residuals / variance. A constant target has no variance,
+// it scores 1 when predicted exactly and 0 otherwise.
+func outputR2(residuals, variance float64) float64 {
+	if variance == 0 {
+		if residuals == 0 {
+			return 1
+		}
+		return 0
+	}
+	return 1 - residuals/variance
+}
+
+func (eval *RegressionEvaluation) GetErrorString() string {
+	return fmt.Sprintf("MSE %.6f, RMSE %.6f, MAE %.6f, R² %.4f over %d samples", eval.MSE, eval.RMSE, eval.MAE, eval.R2, eval.Total)
+}
+
+func (t *Trainer) EvalRegression(useEvalData bool) *RegressionEvaluation {
+	if useEvalData {
+		return t.EvaluateRegression(t.validationData)
+	}
+	return t.EvaluateRegression(t.trainingData)
+}
+
+func (t *Trainer) EvaluateRegression(data []DataPoint) *RegressionEvaluation {
+	predictions := make([][]float64, len(data))
+	targets := make([][]float64, len(data))
+	for i, dp := range data {
+		predictions[i] = t.NN.CalculateOutputs(dp.inputs)
+		targets[i] = dp.expectedOutputs
+	}
+	return NewRegressionEvaluation(predictions, targets)
+}
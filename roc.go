@@ -0,0 +1,145 @@
+package neuralnetwork
+
+import (
+	"math"
+	"sort"
+)
+
+type ROCPoint struct {
+	Threshold float64 `json:"threshold"`
+	FPR       float64 `json:"fpr"`
+	TPR       float64 `json:"tpr"`
+}
+
+type PRPoint struct {
+	Threshold float64 `json:"threshold"`
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+}
+
+// ThresholdAnalysis describes how well scores separate positive samples from
+// negative ones, for every decision threshold.
+type ThresholdAnalysis struct {
+	ROC    []ROCPoint `json:"roc"`
+	PR     []PRPoint  `json:"pr"`
+	ROCAUC float64    `json:"roc_auc"`
+	// PRAUC is the average precision, the precision at each threshold
+	// weighted by the recall it adds.
+	PRAUC float64 `json:"pr_auc"`
+
+	scores    []float64
+	positives []bool
+}
+
+type ThresholdMetric int
+
+const (
+	MaxF1 ThresholdMetric = iota
+	MaxAccuracy
+	// MaxYoudenJ maximizes TPR - FPR.
+	MaxYoudenJ
+)
+
+// thresholdCounts holds the true and false positives when predicting every
+// score >= Threshold as positive.
+type thresholdCounts struct {
+	threshold float64
+	tp, fp    int
+}
+
+// sweepThresholds returns the counts for each distinct score, highest first.
+func sweepThresholds(scores []float64, positives []bool) (counts []thresholdCounts, numPositives int) {
+	assert(len(scores) == len(positives), "scores and positives have different lengths")
+
+	order := make([]int, len(scores))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+
+	tp, fp := 0, 0
+	for i, index := range order {
+		if positives[index] {
+			tp++
+		} else {
+			fp++
+		}
+		// samples with equal scores share a threshold
+		if i+1 < len(order) && scores[order[i+1]] == scores[index] {
+			continue
+		}
+		counts = append(counts, thresholdCounts{threshold: scores[index], tp: tp, fp: fp})
+	}
+	return counts, tp
+}
+
+func AnalyzeThresholds(scores []float64, positives []bool) *ThresholdAnalysis {
+	counts, numPositives := sweepThresholds(scores, positives)
+	numNegatives := len(scores) - numPositives
+
+	a := &ThresholdAnalysis{
+		ROC:       []ROCPoint{{Threshold: math.Inf(1)}},
+		scores:    scores,
+		positives: positives,
+	}
+
+	prevRecall := 0.0
+	for _, c := range counts {
+		tpr := safeDiv(float64(c.tp), float64(numPositives))
+		fpr := safeDiv(float64(c.fp), float64(numNegatives))
+		prev := a.ROC[len(a.ROC)-1]
+		a.ROCAUC += (fpr - prev.FPR) * (tpr + prev.TPR) / 2
+		a.ROC = append(a.ROC, ROCPoint{Threshold: c.threshold, FPR: fpr, TPR: tpr})
+
+		precision := float64(c.tp) / float64(c.tp+c.fp)
+		a.PRAUC += (tpr - prevRecall) * precision
+		prevRecall = tpr
+		a.PR = append(a.PR, PRPoint{Threshold: c.threshold, Precision: precision, Recall: tpr})
+	}
+
+	return a
+}
+
+// BestThreshold returns the threshold maximizing metric when samples scoring
+// at least that much are predicted positive, along with the metric's value.
+func (a *ThresholdAnalysis) BestThreshold(metric ThresholdMetric) (threshold, value float64) {
+	counts, numPositives := sweepThresholds(a.scores, a.positives)
+	numNegatives := len(a.scores) - numPositives
+
+	value = math.Inf(-1)
+	for _, c := range counts {
+		var v float64
+		switch metric {
+		case MaxF1:
+			v = safeDiv(2*float64(c.tp), float64(c.tp+c.fp+numPositives))
+		case MaxAccuracy:
+			v = float64(c.tp+numNegatives-c.fp) / float64(len(a.scores))
+		case MaxYoudenJ:
+			v = safeDiv(float64(c.tp), float64(numPositives)) - safeDiv(float64(c.fp), float64(numNegatives))
+		default:
+			panic("Unhandled threshold metric")
+		}
+
+		if v > value {
+			threshold, value = c.threshold, v
+		}
+	}
+	return threshold, value
+}
+
+// ClassScores runs the network over data and returns the output for class of
+// every sample, with whether class is expected for it. This makes class the
+// positive one, against all the others.
+func (t *Trainer) ClassScores(data []DataPoint, class int) (scores []float64, positives []bool) {
+	scores = make([]float64, len(data))
+	positives = make([]bool, len(data))
+	for i, dp := range data {
+		scores[i] = t.NN.CalculateOutputs(dp.inputs)[class]
+		positives[i] = dp.expectedOutputs[class] >= 0.5
+	}
+	return scores, positives
+}
+
+func (t *Trainer) AnalyzeClass(data []DataPoint, class int) *ThresholdAnalysis {
+	return AnalyzeThresholds(t.ClassScores(data, class))
+}
@@ -0,0 +1,135 @@
+package neuralnetwork
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// ISampler decides which samples make up the mini-batches of an epoch.
+// Batches gets the label of every training sample (-1 when it has none)
+// and returns the indices of each batch's samples. It must draw all its
+// randomness from rng, so resuming from a checkpoint draws the same batches.
+type ISampler interface {
+	Batches(labels []int, batchSize int, rng *rand.Rand) [][]int
+}
+
+// BatchOrderSampler keeps the batches CreateMiniBatches makes, consecutive
+// samples, and only shuffles their order every epoch. It is the default.
+type BatchOrderSampler struct{}
+
+func (s BatchOrderSampler) Batches(labels []int, batchSize int, rng *rand.Rand) [][]int {
+	batches := chunkIndices(identityOrder(len(labels)), batchSize)
+	shuffleWith(rng, batches)
+	return batches
+}
+
+// ShuffleSampler reshuffles every sample each epoch, so the batches change
+// too.
+type ShuffleSampler struct{}
+
+func (s ShuffleSampler) Batches(labels []int, batchSize int, rng *rand.Rand) [][]int {
+	order := identityOrder(len(labels))
+	shuffleWith(rng, order)
+	return chunkIndices(order, batchSize)
+}
+
+// StratifiedSampler spreads each class evenly over the epoch, so every batch
+// holds about the class proportions of the whole data.
+type StratifiedSampler struct{}
+
+// Batches shuffles each class, then places its j-th sample at (j + u) / n_c
+// of the epoch, u being a random offset of the class and n_c its size.
+func (s StratifiedSampler) Batches(labels []int, batchSize int, rng *rand.Rand) [][]int {
+	classes := classIndices(labels)
+	order := make([]int, 0, len(labels))
+	positions := make([]float64, len(labels))
+	for _, class := range classes {
+		shuffleWith(rng, class)
+		offset := rng.Float64()
+		for j, index := range class {
+			positions[index] = (float64(j) + offset) / float64(len(class))
+			order = append(order, index)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return positions[order[a]] < positions[order[b]] })
+	return chunkIndices(order, batchSize)
+}
+
+// BalancedSampler oversamples rare classes: each of the epoch's draws picks a
+// class uniformly, then one of its samples, with replacement.
+type BalancedSampler struct{}
+
+func (s BalancedSampler) Batches(labels []int, batchSize int, rng *rand.Rand) [][]int {
+	classes := classIndices(labels)
+	order := make([]int, len(labels))
+	for i := range order {
+		class := classes[rng.Intn(len(classes))]
+		order[i] = class[rng.Intn(len(class))]
+	}
+	return chunkIndices(order, batchSize)
+}
+
+// WeightedSampler draws every sample of the epoch with replacement, sample i
+// with a probability proportional to Weights[i]. Weights can't be negative
+// and at least one must be positive.
+type WeightedSampler struct {
+	Weights []float64
+}
+
+func (s WeightedSampler) Batches(labels []int, batchSize int, rng *rand.Rand) [][]int {
+	assert(len(s.Weights) == len(labels), "sampler needs one weight per training sample")
+
+	cumulative := make([]float64, len(s.Weights))
+	total := 0.0
+	for i, w := range s.Weights {
+		assert(w >= 0, "sampler weights can't be negative")
+		total += w
+		cumulative[i] = total
+	}
+	assert(total > 0, "sampler weights are all 0")
+
+	order := make([]int, len(labels))
+	for i := range order {
+		order[i] = sort.SearchFloat64s(cumulative, rng.Float64()*total)
+	}
+	return chunkIndices(order, batchSize)
+}
+
+func identityOrder(n int) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
+
+// chunkIndices cuts order into batches of batchSize, the last one holding
+// the rest.
+func chunkIndices(order []int, batchSize int) [][]int {
+	batches := [][]int{}
+	for start := 0; start < len(order); start += batchSize {
+		batches = append(batches, order[start:minInt(start+batchSize, len(order))])
+	}
+	return batches
+}
+
+// classIndices groups the sample indices by label, in label order. Samples
+// without a label form their own group.
+func classIndices(labels []int) [][]int {
+	byLabel := map[int][]int{}
+	for i, label := range labels {
+		byLabel[label] = append(byLabel[label], i)
+	}
+
+	keys := []int{}
+	for label := range byLabel {
+		keys = append(keys, label)
+	}
+	sort.Ints(keys)
+
+	classes := make([][]int, len(keys))
+	for i, label := range keys {
+		classes[i] = byLabel[label]
+	}
+	return classes
+}
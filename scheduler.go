@@ -0,0 +1,199 @@
+package neuralnetwork
+
+import "math"
+
+// IScheduler gives the learning rate for a point in training. epoch is
+// fractional when the trainer steps the schedule per batch.
+type IScheduler interface {
+	Rate(baseRate, epoch float64) float64
+}
+
+// IMetricScheduler is notified of the validation accuracy after every epoch.
+// Reset forgets the accuracies observed, the trainer calls it when a run
+// starts.
+type IMetricScheduler interface {
+	IScheduler
+	Observe(valAccuracy float64)
+	Reset()
+}
+
+type InverseTimeDecay struct {
+	Decay float64
+}
+
+func (s InverseTimeDecay) Rate(baseRate, epoch float64) float64 {
+	return baseRate / (1 + s.Decay*epoch)
+}
+
+// StepDecay multiplies the rate by Gamma every StepSize epochs.
+type StepDecay struct {
+	StepSize float64
+	Gamma    float64
+}
+
+func (s StepDecay) Rate(baseRate, epoch float64) float64 {
+	assert(s.StepSize > 0, "step decay needs a positive step size")
+	return baseRate * math.Pow(s.Gamma, math.Floor(epoch/s.StepSize))
+}
+
+type ExponentialDecay struct {
+	Gamma float64
+}
+
+func (s ExponentialDecay) Rate(baseRate, epoch float64) float64 {
+	return baseRate * math.Pow(s.Gamma, epoch)
+}
+
+// CosineAnnealing anneals from the base rate down to MinRate over Period
+// epochs, then restarts. Each restart multiplies the period by PeriodMult.
+type CosineAnnealing struct {
+	Period     float64
+	PeriodMult float64
+	MinRate    float64
+}
+
+func (s CosineAnnealing) Rate(baseRate, epoch float64) float64 {
+	assert(s.Period > 0, "cosine annealing needs a positive period")
+	period := s.Period
+	mult := s.PeriodMult
+	if mult < 1 {
+		mult = 1
+	}
+
+	for epoch >= period {
+		epoch -= period
+		period *= mult
+	}
+
+	return s.MinRate + 0.5*(baseRate-s.MinRate)*(1+math.Cos(math.Pi*epoch/period))
+}
+
+// LinearWarmup ramps the rate up from StartFactor*baseRate over
+// WarmupEpochs, then hands over to After (or keeps the base rate).
+type LinearWarmup struct {
+	WarmupEpochs float64
+	StartFactor  float64
+	After        IScheduler
+}
+
+func (s LinearWarmup) Rate(baseRate, epoch float64) float64 {
+	if epoch < s.WarmupEpochs {
+		factor := s.StartFactor + (1-s.StartFactor)*epoch/s.WarmupEpochs
+		return baseRate * factor
+	}
+	if s.After == nil {
+		return baseRate
+	}
+	return s.After.Rate(baseRate, epoch-s.WarmupEpochs)
+}
+
+func (s LinearWarmup) Observe(valAccuracy float64) {
+	if ms, ok := s.After.(IMetricScheduler); ok {
+		ms.Observe(valAccuracy)
+	}
+}
+
+func (s LinearWarmup) Reset() {
+	if ms, ok := s.After.(IMetricScheduler); ok {
+		ms.Reset()
+	}
+}
+
+// OneCycle warms up from baseRate/DivFactor to baseRate during the first
+// PctStart of TotalEpochs, then anneals down to baseRate/FinalDivFactor.
+// Zero PctStart, DivFactor and FinalDivFactor pick the NewOneCycle defaults.
+type OneCycle struct {
+	TotalEpochs    float64
+	PctStart       float64
+	DivFactor      float64
+	FinalDivFactor float64
+}
+
+func NewOneCycle(totalEpochs float64) OneCycle {
+	return OneCycle{
+		TotalEpochs:    totalEpochs,
+		PctStart:       0.3,
+		DivFactor:      25,
+		FinalDivFactor: 1e4,
+	}
+}
+
+func (s OneCycle) Rate(baseRate, epoch float64) float64 {
+	defaults := NewOneCycle(s.TotalEpochs)
+	if s.PctStart == 0 {
+		s.PctStart = defaults.PctStart
+	}
+	if s.DivFactor == 0 {
+		s.DivFactor = defaults.DivFactor
+	}
+	if s.FinalDivFactor == 0 {
+		s.FinalDivFactor = defaults.FinalDivFactor
+	}
+	assert(s.TotalEpochs > 0, "one cycle needs a positive number of epochs")
+	assert(s.PctStart > 0 && s.PctStart < 1, "one cycle needs PctStart between 0 and 1")
+
+	initial := baseRate / s.DivFactor
+	final := initial / s.FinalDivFactor
+	peak := s.TotalEpochs * s.PctStart
+
+	if epoch < peak {
+		return cosineInterpolate(initial, baseRate, epoch/peak)
+	}
+	progress := math.Min((epoch-peak)/(s.TotalEpochs-peak), 1)
+	return cosineInterpolate(baseRate, final, progress)
+}
+
+func cosineInterpolate(from, to, progress float64) float64 {
+	return to + 0.5*(from-to)*(1+math.Cos(math.Pi*progress))
+}
+
+// ReduceOnPlateau scales the rate by Factor once the validation accuracy
+// hasn't improved by MinDelta for Patience epochs. The zero state starts at
+// the base rate, so a literal works as well as NewReduceOnPlateau.
+type ReduceOnPlateau struct {
+	Factor   float64
+	Patience int
+	MinDelta float64
+	MinRate  float64
+
+	started bool
+	scale   float64
+	best    float64
+	wait    int
+}
+
+func NewReduceOnPlateau(factor float64, patience int) *ReduceOnPlateau {
+	return &ReduceOnPlateau{
+		Factor:   factor,
+		Patience: patience,
+	}
+}
+
+func (s *ReduceOnPlateau) Reset() {
+	s.started = true
+	s.scale, s.best, s.wait = 1, math.Inf(-1), 0
+}
+
+func (s *ReduceOnPlateau) Rate(baseRate, epoch float64) float64 {
+	if !s.started {
+		s.Reset()
+	}
+	return math.Max(baseRate*s.scale, s.MinRate)
+}
+
+func (s *ReduceOnPlateau) Observe(valAccuracy float64) {
+	if !s.started {
+		s.Reset()
+	}
+	if valAccuracy > s.best+s.MinDelta {
+		s.best = valAccuracy
+		s.wait = 0
+		return
+	}
+
+	s.wait++
+	if s.wait >= s.Patience {
+		s.scale *= s.Factor
+		s.wait = 0
+	}
+}
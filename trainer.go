@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"sync"
 )
 
@@ -12,48 +13,132 @@ type Trainer struct {
 	Config TrainerConf
 	*History
 
-	trainingData    []DataPoint
-	validationData  []DataPoint
-	trainingBatches []Batch
+	trainingData   []DataPoint
+	validationData []DataPoint
 
-	incTrainingData    []ImageFile
-	incValidationData  []ImageFile
-	incTrainingBatches []IncBatch
+	incTrainingData   []ImageFile
+	incValidationData []ImageFile
+
+	activeCallbacks []Callback
+
+	rng       *rand.Rand
+	rngSource *rngSource
+	// dataRand shuffles the trainer's data splits
+	dataRand *rand.Rand
+	// epochRNGState is the RNG state the current epoch's batches were drawn
+	// from
+	epochRNGState uint64
+	resumed       *Checkpoint
 }
 
 type TrainerConf struct {
 	OnEpochComplete func(epochIndex int, evaluation *EvaluationData, EpochLoss float64)
+	Callbacks       []Callback
 	TrainingSplit   float64
 	BatchSize       int
 	Epochs          int
+	// Sampler draws the batches of every epoch, BatchOrderSampler when nil.
+	Sampler ISampler
+	// Seed drives the batch sampling and the trainer's data splits, and the
+	// network's initialization and dropout when NNConf has no seed of its
+	// own. 0 seeds from the time.
+	Seed int64
 
 	Rate, RateDecay          float64
 	Momentum, Regularization float64
+
+	Optimizer    OptimizerType
+	Beta1, Beta2 float64
+	Epsilon      float64
+
+	// Scheduler defaults to InverseTimeDecay driven by RateDecay.
+	Scheduler    IScheduler
+	StepPerBatch bool
+
+	EarlyStopping *EarlyStoppingConf
+	Checkpoint    *CheckpointConf
+
+	// Task picks the validation metrics. For regression and multi-label
+	// tasks OnEpochComplete gets a nil evaluation, callbacks find the
+	// metrics in their context.
+	Task TaskType
+	// Thresholds are the per-label decision thresholds of multi-label
+	// tasks, 0.5 when nil.
+	Thresholds []float64
+	// BalanceClasses sets the network's class weights from the label
+	// frequencies of the training data when training starts.
+	BalanceClasses bool
 }
 
+type TaskType int
+
+const (
+	ClassificationTask TaskType = iota
+	// RegressionTask is for data built with NewRegressionDataPoint.
+	RegressionTask
+	// MultiLabelTask is for data built with NewMultiLabelDataPoint.
+	MultiLabelTask
+)
+
 func NewTrainer(tConf TrainerConf) *Trainer {
+	if tConf.Scheduler == nil {
+		tConf.Scheduler = InverseTimeDecay{Decay: tConf.RateDecay}
+	}
+	if tConf.Sampler == nil {
+		tConf.Sampler = BatchOrderSampler{}
+	}
+
 	t := &Trainer{
 		Config: tConf,
 		History: &History{
 			Loss: []float64{},
 			Acc:  []float64{},
+			Rate: []float64{},
 		},
 	}
+	seeds := newRand(tConf.Seed)
+	t.rngSource = newRNGSource(seeds.Int63())
+	t.rng = rand.New(t.rngSource)
+	t.dataRand = rand.New(rand.NewSource(seeds.Int63()))
 
 	return t
 }
 
 func (t *Trainer) NNInit(nnConf NNConf) {
+	if nnConf.Seed == 0 {
+		nnConf.Seed = t.Config.Seed
+	}
 	t.NN = NewNN(
 		nnConf,
 		t.History,
 	)
+	t.NN.SetOptimizer(t.newOptimizer())
+}
+
+func (t *Trainer) newOptimizer() IOptimizer {
+	return GetOptimizerFromType(t.Config.Optimizer, OptimizerConf{
+		Momentum: t.Config.Momentum,
+		Beta1:    t.Config.Beta1,
+		Beta2:    t.Config.Beta2,
+		Epsilon:  t.Config.Epsilon,
+	})
+}
+
+// SplitData splits data like the package SplitData, at
+// Config.TrainingSplit and shuffled by the trainer's seed.
+func (t *Trainer) SplitData(data []DataPoint) (training, validation []DataPoint) {
+	return splitData(t.dataRand, data, t.Config.TrainingSplit)
+}
+
+// StratifiedSplit is the package StratifiedSplit, shuffled by the trainer's
+// seed.
+func (t *Trainer) StratifiedSplit(data []DataPoint, trainingSplit, validationSplit float64) (training, validation, test []DataPoint) {
+	return stratifiedSplit(t.dataRand, data, trainingSplit, validationSplit)
 }
 
 func (t *Trainer) LoadCustomData(training, validation []DataPoint) {
 	println("[INFO] Loading Data")
 	t.trainingData, t.validationData = training, validation
-	t.trainingBatches = CreateMiniBatches(t.trainingData, t.Config.BatchSize)
 }
 
 func (t *Trainer) LoadMNISTData(path string) {
@@ -68,33 +153,178 @@ func (t *Trainer) LoadMNISTData(path string) {
 	println("[INFO] Loading MNIST Data")
 	t.trainingData = LoadMNISTData(TRAINING_DATA, TRAINING_LABELS)
 	t.validationData = LoadMNISTData(EVAL_DATA, EVAL_LABELS)
-	t.trainingBatches = CreateMiniBatches(t.trainingData, t.Config.BatchSize)
 }
 
 func (t *Trainer) Train() {
 	println("[INFO] Started Training")
-	currentRate := t.Config.Rate
-	totalBatches := len(t.trainingBatches)
-	for epochIdx := 0; epochIdx < t.Config.Epochs; epochIdx++ {
-		epochLoss := 0.0
-		for i := 0; i < totalBatches; i++ {
+	labels := make([]int, len(t.trainingData))
+	for i, dp := range t.trainingData {
+		labels[i] = dp.label
+	}
+	if t.Config.BalanceClasses {
+		assert(t.Config.Task == ClassificationTask, "classes can only be balanced for classification")
+		t.NN.Config.ClassWeights = BalancedClassWeights(labels, len(t.trainingData[0].expectedOutputs))
+	}
+
+	t.fit(trainingRun{
+		labels: labels,
+		batch: func(indices []int) []DataPoint {
+			batch := make([]DataPoint, len(indices))
+			for i, index := range indices {
+				batch[i] = t.trainingData[index]
+			}
+			return batch
+		},
+		evaluate: func() *EvaluationData {
+			return t.Eval(true)
+		},
+		evaluateRegression: func() *RegressionEvaluation {
+			return t.EvalRegression(true)
+		},
+		evaluateMultiLabel: func() *MultiLabelEvaluation {
+			return t.EvalMultiLabel(true)
+		},
+		validationLoss: func() float64 {
+			return t.NN.calculateTotalLoss(t.validationData) / float64(len(t.validationData))
+		},
+	})
+}
+
+// trainingRun abstracts where batches come from so in-memory and
+// incremental training share the same epoch loop.
+type trainingRun struct {
+	// labels holds the label of every training sample, for the sampler
+	labels             []int
+	batch              func(indices []int) []DataPoint
+	evaluate           func() *EvaluationData
+	evaluateRegression func() *RegressionEvaluation
+	evaluateMultiLabel func() *MultiLabelEvaluation
+	validationLoss     func() float64
+}
+
+func (t *Trainer) fit(run trainingRun) {
+	totalBatches := (len(run.labels) + t.Config.BatchSize - 1) / t.Config.BatchSize
+	callbacks := t.callbacks()
+	t.activeCallbacks = callbacks
+
+	ctx := &CallbackContext{
+		Trainer:        t,
+		NumBatches:     totalBatches,
+		Rate:           t.Config.Rate,
+		validationLoss: run.validationLoss,
+		valLossEpoch:   -1,
+	}
+	startEpoch, startBatch := t.startPosition(ctx)
+
+	for _, cb := range callbacks {
+		cb.OnTrainBegin(ctx)
+	}
+
+	for epochIdx := startEpoch; epochIdx < t.Config.Epochs && !ctx.stop; epochIdx++ {
+		ctx.Epoch = epochIdx
+		t.epochRNGState = t.rngSource.state
+		batches := t.Config.Sampler.Batches(run.labels, t.Config.BatchSize, t.rng)
+		totalBatches = len(batches)
+		ctx.NumBatches = totalBatches
+		if startBatch == 0 {
+			ctx.epochLossSum = 0
+		}
+
+		for _, cb := range callbacks {
+			cb.OnEpochBegin(ctx)
+		}
+
+		for i := startBatch; i < totalBatches && !ctx.stop; i++ {
+			ctx.Batch = i
 			displayProgress(i, totalBatches)
-			t.NN.Learn(t.trainingBatches[i].data, currentRate, t.Config.Regularization, t.Config.Momentum)
+			ctx.Rate = t.scheduledRate(epochIdx, i, totalBatches)
+			for _, cb := range callbacks {
+				cb.OnBatchBegin(ctx)
+			}
+
+			batch := run.batch(batches[i])
+			t.NN.Learn(batch, ctx.Rate, t.Config.Regularization)
+
+			ctx.BatchLoss = t.NN.calculateTotalLoss(batch)
+			ctx.epochLossSum += ctx.BatchLoss
+			ctx.EpochLoss = ctx.epochLossSum / float64(i+1)
+			for _, cb := range callbacks {
+				cb.OnBatchEnd(ctx)
+			}
+		}
+		if ctx.stop {
+			break
+		}
+		startBatch = 0
+
+		t.evaluateEpoch(run, ctx)
+		t.History.Loss = append(t.History.Loss, ctx.EpochLoss)
+		t.History.Rate = append(t.History.Rate, ctx.Rate)
+		t.observeSchedule(ctx)
 
-			epochLoss += t.NN.calculateTotalLoss(t.trainingBatches[i].data)
+		for _, cb := range callbacks {
+			cb.OnEvaluate(ctx)
 		}
+		for _, cb := range callbacks {
+			cb.OnEpochEnd(ctx)
+		}
+	}
 
-		evalutation := t.Eval(true)
-		epochLoss = epochLoss / float64(totalBatches)
-		t.History.Loss = append(t.History.Loss, epochLoss)
-		t.History.Acc = append(t.History.Acc, evalutation.GettAccuracy())
+	for _, cb := range callbacks {
+		cb.OnTrainEnd(ctx)
+	}
+}
 
-		if t.Config.OnEpochComplete != nil {
-			t.Config.OnEpochComplete(epochIdx, evalutation, epochLoss)
+// startPosition returns where a resumed checkpoint left off, the start
+// otherwise, with the metric scheduler reset.
+func (t *Trainer) startPosition(ctx *CallbackContext) (epoch, batch int) {
+	if t.resumed != nil {
+		cp := t.resumed
+		t.resumed = nil
+
+		ctx.Resumed = true
+		ctx.epochLossSum = cp.EpochLoss
+		if es := t.earlyStopping(); es != nil && cp.EarlyStopping != nil {
+			es.restoreState(cp.EarlyStopping)
 		}
+		return cp.Epoch, cp.Batch
+	}
 
-		ShuffleBatches(t.trainingBatches)
-		currentRate = (1.0 / (1.0 + t.Config.RateDecay*float64(epochIdx))) * t.Config.Rate
+	if scheduler, ok := t.Config.Scheduler.(IMetricScheduler); ok {
+		scheduler.Reset()
+	}
+	return 0, 0
+}
+
+func (t *Trainer) scheduledRate(epochIdx, batchIdx, totalBatches int) float64 {
+	epoch := float64(epochIdx)
+	if t.Config.StepPerBatch {
+		epoch += float64(batchIdx) / float64(totalBatches)
+	}
+	return t.Config.Scheduler.Rate(t.Config.Rate, epoch)
+}
+
+func (t *Trainer) evaluateEpoch(run trainingRun, ctx *CallbackContext) {
+	switch t.Config.Task {
+	case ClassificationTask:
+		ctx.Evaluation = run.evaluate()
+		t.History.Acc = append(t.History.Acc, ctx.Evaluation.GettAccuracy())
+	case RegressionTask:
+		assert(run.evaluateRegression != nil, "regression isn't supported by this training run")
+		ctx.Regression = run.evaluateRegression()
+		t.History.Regression = append(t.History.Regression, *ctx.Regression)
+	case MultiLabelTask:
+		assert(run.evaluateMultiLabel != nil, "multi-label isn't supported by this training run")
+		ctx.MultiLabel = run.evaluateMultiLabel()
+		t.History.MultiLabel = append(t.History.MultiLabel, *ctx.MultiLabel)
+	default:
+		panic("Unhandled task type")
+	}
+}
+
+func (t *Trainer) observeSchedule(ctx *CallbackContext) {
+	if scheduler, ok := t.Config.Scheduler.(IMetricScheduler); ok {
+		scheduler.Observe(ctx.score())
 	}
 }
 
@@ -114,18 +344,10 @@ func (t *Trainer) Evaluate(data []DataPoint) *EvaluationData {
 
 	for _, dp := range data {
 		output := t.NN.CalculateOutputs(dp.inputs)
-		predictedLabel := MaxValueIndex(output)
 
 		mu.Lock()
 
-		evalData.totalPerClass[dp.label]++
-
-		if predictedLabel == dp.label {
-			evalData.numCorrectPerClass[dp.label]++
-			evalData.numCorrect++
-		} else {
-			evalData.wronglyPredictedAs[predictedLabel]++
-		}
+		evalData.add(dp.label, output)
 
 		mu.Unlock()
 	}
@@ -137,6 +359,10 @@ func (t *Trainer) Classify(inputs []float64) []float64 {
 	return t.NN.CalculateOutputs(inputs)
 }
 
+func (t *Trainer) PredictTopK(inputs []float64, k int) []Prediction {
+	return t.NN.PredictTopK(inputs, k)
+}
+
 func (t *Trainer) PredictSingle(data DataPoint) int {
 	output := t.Classify(data.inputs)
 	for i, percentage := range output {
@@ -153,7 +379,7 @@ func (t *Trainer) PredictSingle(data DataPoint) int {
 }
 
 func (t *Trainer) SaveNN(path string) error {
-	jsonData, err := json.MarshalIndent(*t.NN, "", "  ")
+	jsonData, err := json.MarshalIndent(t.NN, "", "  ")
 	if err != nil {
 		return err
 	}
@@ -178,8 +404,7 @@ func (t *Trainer) LoadNNFromFile(path string) error {
 		return err
 	}
 
-	t.NN.SetActivationFns(t.NN.Config.Activation, t.NN.Config.OutActivation)
-	t.NN.SetLossFns(t.NN.Config.Loss)
+	t.NN.SetOptimizer(t.newOptimizer())
 
 	return nil
 }
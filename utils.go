@@ -4,6 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
 )
 
 func displayProgress(number, total int) {
@@ -31,6 +36,29 @@ func MaxValueIndex(outputs []float64) int {
 	return index
 }
 
+// labelRank is the position of label when sorting outputs like topK does.
+func labelRank(outputs []float64, label int) int {
+	rank := 0
+	for i, val := range outputs {
+		if val > outputs[label] || (val == outputs[label] && i < label) {
+			rank++
+		}
+	}
+	return rank
+}
+
+// topK returns the indices of the k highest outputs, highest first. Equal
+// outputs keep their order.
+func topK(outputs []float64, k int) []int {
+	assert(k >= 0, "top k needs a non-negative k")
+	indices := make([]int, len(outputs))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.SliceStable(indices, func(a, b int) bool { return outputs[indices[a]] > outputs[indices[b]] })
+	return indices[:minInt(k, len(indices))]
+}
+
 // helped with debugging
 func d(v any) {
 	b, err := json.MarshalIndent(v, "", "  ")
@@ -49,3 +77,111 @@ func assert(cond bool, msg string) {
 		panic(msg)
 	}
 }
+
+// rngSource is a splitmix64 generator. Unlike the math/rand sources its whole
+// state is a single word, so it can be saved in a checkpoint.
+type rngSource struct {
+	state uint64
+}
+
+func newRNGSource(seed int64) *rngSource {
+	return &rngSource{state: uint64(seed)}
+}
+
+func (s *rngSource) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+func (s *rngSource) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *rngSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func numWorkers() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// parallelChunks splits [0, n) into at most GOMAXPROCS contiguous chunks and
+// runs fn on each concurrently. The split only depends on n and the worker
+// count, worker being the chunk index.
+func parallelChunks(n int, fn func(worker, start, end int)) {
+	workers := minInt(numWorkers(), n)
+	if workers <= 1 {
+		if n > 0 {
+			fn(0, 0, n)
+		}
+		return
+	}
+
+	chunk := (n + workers - 1) / workers
+	var wg sync.WaitGroup
+	for w := 0; w*chunk < n; w++ {
+		start, end := w*chunk, minInt((w+1)*chunk, n)
+		wg.Add(1)
+		go func(w, start, end int) {
+			defer wg.Done()
+			fn(w, start, end)
+		}(w, start, end)
+	}
+	wg.Wait()
+}
+
+// parallelFor runs fn for every index in [0, n) on the worker chunks.
+func parallelFor(n int, fn func(i int)) {
+	parallelChunks(n, func(_, start, end int) {
+		for i := start; i < end; i++ {
+			fn(i)
+		}
+	})
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// newRand seeds a generator with seed, or with the time when seed is 0.
+func newRand(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// lockedSource lets goroutines share a generator.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// dataRand shuffles and splits data in the package level helpers. Trainers
+// use their own, seeded by TrainerConf.Seed.
+var dataRand = rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano())})
+
+func shuffleWith[T any](rng *rand.Rand, items []T) {
+	for i := len(items) - 1; i > 0; i-- {
+		j := rng.Intn(i + 1)
+		items[i], items[j] = items[j], items[i]
+	}
+}